@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// handleAdminRequest serves the /admin/ endpoints. They are disabled unless
+// ADMIN_TOKEN is set, and then require it as the Bearer token.
+func handleAdminRequest(w http.ResponseWriter, r *http.Request) {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "", fmt.Sprintf("Invalid URL (%s %s)", r.Method, r.URL.Path))
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		logFor(r.Context()).Warn("Rejected admin request", "path", r.URL.Path)
+		writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Invalid admin token")
+		return
+	}
+	if r.Method != "GET" {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "", fmt.Sprintf("Method %s not allowed, use GET", r.Method))
+		return
+	}
+
+	switch r.URL.Path {
+	case "/admin/keys":
+		writeJSON(w, map[string]interface{}{"providers": keyPoolStatuses()})
+	case "/admin/usage":
+		handleUsageReport(w, r)
+	default:
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "", fmt.Sprintf("Invalid URL (%s %s)", r.Method, r.URL.Path))
+	}
+}
+
+// keyPoolStatuses returns the key pool state of every provider in use
+func keyPoolStatuses() []keyPoolStatus {
+	providersMu.Lock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pools := make([]*keyPool, 0, len(names))
+	for _, name := range names {
+		pools = append(pools, providers[name].Keys())
+	}
+	providersMu.Unlock()
+
+	out := make([]keyPoolStatus, 0, len(pools))
+	for _, pool := range pools {
+		out = append(out, pool.status())
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
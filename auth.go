@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Client authentication modes, selected with AUTH_MODE
+const (
+	// authModeTokens accepts only the tokens from the clients file
+	authModeTokens = "tokens"
+	// authModePassthrough forwards the client's bearer token as the upstream key
+	authModePassthrough = "passthrough"
+	// authModeNone lets anyone use the server keys
+	authModeNone = "none"
+)
+
+// proxyClient is a user allowed to call the proxy
+type proxyClient struct {
+	Token string `yaml:"token"`
+	User  string `yaml:"user"`
+	// Keys optionally pins the client to its own upstream key per provider
+	// name; providers not listed use the server key pool
+	Keys map[string]string `yaml:"keys"`
+	// RequestsPerMinute and TokensPerDay override the default limits; 0 means
+	// unlimited
+	RequestsPerMinute *int `yaml:"requests_per_minute"`
+	TokensPerDay      *int `yaml:"tokens_per_day"`
+
+	// byoKey is the client's own upstream key in passthrough mode
+	byoKey string
+}
+
+// upstreamKey returns the key the client's requests to provider are sent with,
+// or "" to use the provider's key pool
+func (c *proxyClient) upstreamKey(provider string) string {
+	if c.byoKey != "" {
+		return c.byoKey
+	}
+	return c.Keys[provider]
+}
+
+type clientsConfig struct {
+	Clients []*proxyClient `yaml:"clients"`
+}
+
+var (
+	authMode = authModeTokens
+	// clientsByToken is filled from the clients file at startup
+	clientsByToken = map[string]*proxyClient{}
+)
+
+// setupAuth reads AUTH_MODE and, in tokens mode, the clients file
+func setupAuth(clientsPath string) error {
+	authMode = firstNonEmpty(os.Getenv("AUTH_MODE"), authModeTokens)
+	switch authMode {
+	case authModeTokens:
+		if clientsPath == "" {
+			return fmt.Errorf("AUTH_MODE=%s needs a clients file (CLIENTS_CONFIG or -clients); set AUTH_MODE=%s or %s to run without one", authModeTokens, authModePassthrough, authModeNone)
+		}
+		return loadClients(clientsPath)
+	case authModePassthrough:
+		slog.Info("Client authentication: passthrough, client bearer tokens are forwarded as upstream keys")
+	case authModeNone:
+		slog.Warn("Client authentication disabled, anyone reaching the proxy can use the server keys")
+	default:
+		return fmt.Errorf("unknown AUTH_MODE %q, available: %s, %s, %s", authMode, authModeTokens, authModePassthrough, authModeNone)
+	}
+	return nil
+}
+
+func loadClients(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg clientsConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	for i, c := range cfg.Clients {
+		if c.Token == "" || c.User == "" {
+			return fmt.Errorf("client %d needs both token and user", i+1)
+		}
+		if _, dup := clientsByToken[c.Token]; dup {
+			return fmt.Errorf("client %q reuses the token of another client", c.User)
+		}
+		if (c.RequestsPerMinute != nil && *c.RequestsPerMinute < 0) || (c.TokensPerDay != nil && *c.TokensPerDay < 0) {
+			return fmt.Errorf("client %q has a negative limit", c.User)
+		}
+		for name := range c.Keys {
+			if _, ok := providerSpecs[name]; !ok {
+				return fmt.Errorf("client %q: unknown provider %q, available: %s", c.User, name, strings.Join(providerNames(), ", "))
+			}
+		}
+		clientsByToken[c.Token] = c
+		registerSecret(c.Token)
+		for _, key := range c.Keys {
+			registerSecret(key)
+		}
+	}
+	slog.Info("Client authentication: client tokens loaded", "clients", len(clientsByToken))
+	return nil
+}
+
+// requestToken returns the token the client sent as Bearer or x-api-key
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return strings.TrimSpace(r.Header.Get("x-api-key"))
+}
+
+// authenticateClient identifies the caller according to the auth mode,
+// answering with an OpenAI-style 401 and returning nil when it is rejected
+func authenticateClient(w http.ResponseWriter, r *http.Request) *proxyClient {
+	token := requestToken(r)
+	switch authMode {
+	case authModeNone:
+		return &proxyClient{User: "anonymous"}
+	case authModePassthrough:
+		if token == "" {
+			writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key",
+				"API key required: provide your upstream API key as the Bearer token")
+			return nil
+		}
+		return &proxyClient{User: "passthrough", byoKey: token}
+	}
+
+	if token == "" {
+		writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key",
+			"API key required: provide your proxy token as the Bearer token")
+		return nil
+	}
+	client, ok := clientsByToken[token]
+	if !ok {
+		logFor(r.Context()).Warn("Rejected unknown client token", "client_token", maskKey(token))
+		writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key",
+			"Incorrect API key provided: "+maskKey(token))
+		return nil
+	}
+	return client
+}
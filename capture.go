@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture files, one directory per chat completion request. The upstream
+// response and the client response are .sse for streams and .json otherwise.
+const (
+	captureMetaFile            = "meta.json"
+	captureRequestFile         = "request.json"
+	captureUpstreamRequestFile = "upstream_request.json"
+	captureUpstreamResponse    = "upstream_response"
+	captureResponse            = "response"
+)
+
+const defaultCaptureMax = 100
+
+// captureMeta describes a captured request, written as meta.json
+type captureMeta struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	// Model is the client-facing model the request was sent as, after fallback
+	Model          string `json:"model,omitempty"`
+	ServedModel    string `json:"served_model,omitempty"`
+	Provider       string `json:"provider,omitempty"`
+	Stream         bool   `json:"stream"`
+	Status         int    `json:"status"`
+	UpstreamStatus int    `json:"upstream_status,omitempty"`
+}
+
+func captureExt(stream bool) string {
+	if stream {
+		return ".sse"
+	}
+	return ".json"
+}
+
+// captureStore writes captures to dir, keeping the newest max of them
+type captureStore struct {
+	dir string
+	max int
+	mu  sync.Mutex
+}
+
+// captures is set in main when CAPTURE_DIR is set; nil disables capturing
+var captures *captureStore
+
+func captureStoreFromEnv() (*captureStore, error) {
+	dir := os.Getenv("CAPTURE_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	max := defaultCaptureMax
+	if v := os.Getenv("CAPTURE_MAX"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid CAPTURE_MAX %q, expected a positive number", v)
+		}
+		max = n
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	slog.Info("Capturing requests", "dir", dir, "max", max)
+	return &captureStore{dir: dir, max: max}, nil
+}
+
+// capture collects the four stages of one request: the client request, the
+// translated upstream request, the raw upstream response and the response
+// sent to the client. A nil capture records nothing.
+type capture struct {
+	store    *captureStore
+	meta     captureMeta
+	request  []byte
+	call     *upstreamCall
+	upstream bytes.Buffer
+	response bytes.Buffer
+}
+
+// start begins capturing a client request
+func (s *captureStore) start(requestID string, body []byte) *capture {
+	if s == nil {
+		return nil
+	}
+	return &capture{store: s, meta: captureMeta{Time: time.Now().UTC(), RequestID: requestID}, request: body}
+}
+
+// wrap returns a ResponseWriter that also records the response
+func (c *capture) wrap(w http.ResponseWriter) http.ResponseWriter {
+	if c == nil {
+		return w
+	}
+	return &captureWriter{ResponseWriter: w, buf: &c.response}
+}
+
+// recordUpstream records the call that is answered to the client and tees its
+// response body as the translator reads it
+func (c *capture) recordUpstream(call *upstreamCall) {
+	if c == nil {
+		return
+	}
+	c.call = call
+	if call.errBody != nil {
+		// Error responses are answered from errBody, the body is already read
+		c.upstream.Write(call.errBody)
+		return
+	}
+	body := call.resp.Body
+	call.resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, &c.upstream), body}
+}
+
+// save writes the capture once the response is complete
+func (c *capture) save(status int) {
+	if c == nil {
+		return
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	c.meta.Status = status
+
+	files := map[string][]byte{captureRequestFile: c.request}
+	ext := captureExt(false)
+	if call := c.call; call != nil {
+		c.meta.Model = call.model
+		c.meta.ServedModel = call.servedModel
+		c.meta.Provider = call.provider.Name()
+		c.meta.Stream = call.ur.Stream
+		c.meta.UpstreamStatus = call.resp.StatusCode
+		ext = captureExt(call.ur.Stream && call.resp.StatusCode < 400)
+
+		upstream := c.upstream.Bytes()
+		if enc := call.resp.Header.Get("Content-Encoding"); enc != "" {
+			// Store what the translator saw, not the compressed bytes
+			decoded, err := readResponse(&http.Response{Header: http.Header{"Content-Encoding": {enc}}, Body: io.NopCloser(bytes.NewReader(upstream))})
+			if err == nil {
+				upstream = decoded
+			}
+		}
+		files[captureUpstreamRequestFile] = call.ur.Body
+		files[captureUpstreamResponse+ext] = upstream
+	}
+	files[captureResponse+ext] = c.response.Bytes()
+	files[captureMetaFile], _ = json.MarshalIndent(c.meta, "", "  ")
+
+	if err := c.store.write(c.meta, files); err != nil {
+		slog.Error("Error writing capture", "request_id", c.meta.RequestID, "error", err)
+	}
+}
+
+// write stores one capture, with every file passed through redact, and
+// removes the oldest captures beyond max
+func (s *captureStore) write(meta captureMeta, files map[string][]byte) error {
+	name := meta.Time.Format("20060102T150405.000") + "-" + strings.ReplaceAll(meta.RequestID, ":", "-")
+	dir := filepath.Join(s.dir, name)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	for file, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(redact(string(data))), 0600); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	// Names start with the time, so they sort oldest first
+	sort.Strings(names)
+	for len(names) > s.max {
+		if err := os.RemoveAll(filepath.Join(s.dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// captureWriter copies everything written to the client into buf
+type captureWriter struct {
+	http.ResponseWriter
+	buf *bytes.Buffer
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	cw.buf.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *captureWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useCaptures captures requests into a temporary directory, keeping the
+// newest max of them, for the rest of the test
+func useCaptures(t *testing.T, max int) *captureStore {
+	t.Helper()
+	old := captures
+	t.Cleanup(func() { captures = old })
+	captures = &captureStore{dir: t.TempDir(), max: max}
+	return captures
+}
+
+// captureDir returns the only capture in store
+func captureDir(t *testing.T, store *captureStore) string {
+	t.Helper()
+	dirs, err := captureDirs(store.dir)
+	if err != nil || len(dirs) != 1 {
+		t.Fatalf("captures = %v, %v; want exactly one", dirs, err)
+	}
+	return dirs[0]
+}
+
+// capturedSecretRequest carries a key in its message, as a client pasting a
+// curl command would
+const capturedSecretRequest = `{"model":"claude-sonnet-4.5","stream":%s,"messages":[{"role":"user","content":` +
+	`"Why does Authorization: Bearer sk-ant-REDACTED fail with x-api-key: captured-header-key?"}]}`
+
+func TestCapture(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  bool
+		replies []upstreamReply
+		// wantFiles are the files of the capture, besides meta.json
+		wantFiles []string
+	}{
+		{
+			name:      "response",
+			replies:   []upstreamReply{anthropicResponse("Hello!")},
+			wantFiles: []string{"request.json", "response.json", "upstream_request.json", "upstream_response.json"},
+		},
+		{
+			name:      "stream",
+			stream:    true,
+			replies:   []upstreamReply{{events: anthropicToolStream}},
+			wantFiles: []string{"request.json", "response.sse", "upstream_request.json", "upstream_response.sse"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newMockUpstream(t, tc.replies...)
+			useProvider(t, "o2a", upstream.URL)
+			store := useCaptures(t, 10)
+
+			stream := "false"
+			if tc.stream {
+				stream = "true"
+			}
+			rec := postChat(t, strings.Replace(capturedSecretRequest, "%s", stream, 1))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+			}
+
+			dir := captureDir(t, store)
+			entries, _ := os.ReadDir(dir)
+			var files []string
+			for _, e := range entries {
+				files = append(files, e.Name())
+			}
+			want := append([]string{captureMetaFile}, tc.wantFiles...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(files, want) {
+				t.Fatalf("capture files = %v, want %v", files, want)
+			}
+			for _, file := range files {
+				data, _ := os.ReadFile(filepath.Join(dir, file))
+				for _, secret := range []string{"sk-ant-REDACTED", "captured-header-key"} {
+					if strings.Contains(string(data), secret) {
+						t.Errorf("%s leaks %q: %s", file, secret, data)
+					}
+				}
+				if len(data) == 0 {
+					t.Errorf("%s is empty", file)
+				}
+			}
+			meta, _ := os.ReadFile(filepath.Join(dir, captureMetaFile))
+			for _, field := range []string{`"provider": "o2a"`, `"status": 200`, `"upstream_status": 200`} {
+				if !strings.Contains(string(meta), field) {
+					t.Errorf("meta.json = %s, want %s", meta, field)
+				}
+			}
+		})
+	}
+}
+
+func TestCaptureRotation(t *testing.T) {
+	store := &captureStore{dir: t.TempDir(), max: 2}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, id := range []string{"req-1", "req-2", "req-3"} {
+		meta := captureMeta{Time: start.Add(time.Duration(i) * time.Second), RequestID: id}
+		if err := store.write(meta, map[string][]byte{captureMetaFile: []byte("{}")}); err != nil {
+			t.Fatalf("write %s: %v", id, err)
+		}
+	}
+
+	entries, _ := os.ReadDir(store.dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"20260102T030406.000-req-2", "20260102T030407.000-req-3"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("captures = %v, want the oldest removed: %v", names, want)
+	}
+}
@@ -0,0 +1,939 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Client requests
+
+func chatRequest(model string, stream bool) string {
+	return fmt.Sprintf(`{"model":%q,"stream":%t,"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hi"}]}`, model, stream)
+}
+
+func toolRequest(model string, stream bool) string {
+	return fmt.Sprintf(`{"model":%q,"stream":%t,"messages":[{"role":"user","content":"Read main.go"}],`+
+		`"tools":[{"type":"function","function":{"name":"read_file","description":"Read a file","parameters":{"type":"object","properties":{"path":{"type":"string"}},"required":["path"]}}}]}`,
+		model, stream)
+}
+
+// OpenAI-compatible upstream replies, as sent by DeepSeek and POE
+
+func openAIResponse(content string) upstreamReply {
+	return upstreamReply{body: `{"id":"chatcmpl-1","object":"chat.completion","created":1700000000,"model":"upstream-model",` +
+		`"choices":[{"index":0,"message":{"role":"assistant","content":` + fmt.Sprintf("%q", content) + `},"finish_reason":"stop"}],` +
+		`"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`}
+}
+
+func openAIChunk(delta, finishReason string) string {
+	finish := "null"
+	if finishReason != "" {
+		finish = `"` + finishReason + `"`
+	}
+	return dataEvent(`{"id":"chatcmpl-1","object":"chat.completion.chunk","created":1700000000,"model":"upstream-model","choices":[{"index":0,"delta":` + delta + `,"finish_reason":` + finish + `}]}`)
+}
+
+var openAIToolStream = []string{
+	openAIChunk(`{"role":"assistant","content":""}`, ""),
+	openAIChunk(`{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"read_file","arguments":""}}]}`, ""),
+	openAIChunk(`{"tool_calls":[{"index":0,"function":{"arguments":"{\"path\":"}}]}`, ""),
+	openAIChunk(`{"tool_calls":[{"index":0,"function":{"arguments":"\"main.go\"}"}}]}`, ""),
+	openAIChunk(`{}`, "tool_calls"),
+	dataEvent(`{"id":"chatcmpl-1","object":"chat.completion.chunk","created":1700000000,"model":"upstream-model","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":8,"total_tokens":28}}`),
+	dataEvent(`[DONE]`),
+}
+
+// Anthropic upstream replies
+
+func anthropicResponse(content string) upstreamReply {
+	return upstreamReply{body: `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929",` +
+		`"content":[{"type":"text","text":` + fmt.Sprintf("%q", content) + `}],"stop_reason":"end_turn","stop_sequence":null,` +
+		`"usage":{"input_tokens":9,"output_tokens":2}}`}
+}
+
+var anthropicToolStream = []string{
+	anthropicEvent("message_start", `{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[],"stop_reason":null,"usage":{"input_tokens":20,"output_tokens":1}}}`),
+	anthropicEvent("content_block_start", `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`),
+	anthropicEvent("ping", `{"type":"ping"}`),
+	anthropicEvent("content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Reading it."}}`),
+	anthropicEvent("content_block_stop", `{"type":"content_block_stop","index":0}`),
+	anthropicEvent("content_block_start", `{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"read_file","input":{}}}`),
+	anthropicEvent("content_block_delta", `{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"path\":"}}`),
+	anthropicEvent("content_block_delta", `{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"main.go\"}"}}`),
+	anthropicEvent("content_block_stop", `{"type":"content_block_stop","index":1}`),
+	anthropicEvent("message_delta", `{"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":8}}`),
+	anthropicEvent("message_stop", `{"type":"message_stop"}`),
+}
+
+var anthropicRateLimit = upstreamReply{
+	status: http.StatusTooManyRequests,
+	header: map[string]string{"retry-after": "7", "anthropic-ratelimit-requests-reset": "2026-01-01T00:00:07Z"},
+	body:   `{"type":"error","error":{"type":"rate_limit_error","message":"Number of requests has exceeded your rate limit"}}`,
+}
+
+type chatCase struct {
+	name     string
+	provider string
+	request  string
+	replies  []upstreamReply
+	// wantStatus is the status returned to the client, 200 when unset
+	wantStatus int
+	// wantChunks are the SSE data payloads of a streamed response, wantBody
+	// the JSON body of a regular one
+	wantChunks []string
+	wantBody   string
+	// wantHeader are response headers to check, "" for ones that must be absent
+	wantHeader map[string]string
+	// checkUpstream inspects the requests the upstream received
+	checkUpstream func(t *testing.T, reqs []upstreamRequest)
+}
+
+func runChatCases(t *testing.T, cases []chatCase) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newMockUpstream(t, tc.replies...)
+			useProvider(t, tc.provider, upstream.URL)
+
+			rec := postChat(t, tc.request)
+
+			wantStatus := tc.wantStatus
+			if wantStatus == 0 {
+				wantStatus = http.StatusOK
+			}
+			if rec.Code != wantStatus {
+				t.Errorf("status = %d, want %d; body: %s", rec.Code, wantStatus, rec.Body)
+			}
+			if tc.wantChunks != nil {
+				if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+					t.Errorf("Content-Type = %q, want text/event-stream", ct)
+				}
+				got := sseData(rec.Body.String())
+				if strings.Join(got, "\n") != strings.Join(tc.wantChunks, "\n") {
+					t.Errorf("stream chunks:\n got: %s\nwant: %s", strings.Join(got, "\n      "), strings.Join(tc.wantChunks, "\n      "))
+				}
+			}
+			if tc.wantBody != "" {
+				if got, want := canonicalJSON(t, rec.Body.String()), canonicalJSON(t, tc.wantBody); got != want {
+					t.Errorf("body:\n got: %s\nwant: %s", got, want)
+				}
+			}
+			for k, want := range tc.wantHeader {
+				if got := rec.Header().Get(k); got != want {
+					t.Errorf("header %s = %q, want %q", k, got, want)
+				}
+			}
+			if tc.checkUpstream != nil {
+				tc.checkUpstream(t, upstream.received())
+			}
+		})
+	}
+}
+
+// relayedToolStream is openAIToolStream as relayed by handleOpenAIStream: the
+// chunks are re-encoded with the client's model name, and the usage chunk is
+// dropped because the client did not ask for it
+func relayedToolStream(model string) []string {
+	chunk := func(delta, finish string) string {
+		return `{"choices":[{"delta":` + delta + `,"finish_reason":` + finish + `,"index":0}],"created":0,"id":"chatcmpl-1","model":"` + model + `","object":"chat.completion.chunk"}`
+	}
+	return []string{
+		chunk(`{"content":"","role":"assistant"}`, "null"),
+		chunk(`{"tool_calls":[{"function":{"arguments":"","name":"read_file"},"id":"call_1","index":0,"type":"function"}]}`, "null"),
+		chunk(`{"tool_calls":[{"function":{"arguments":"{\"path\":"},"index":0}]}`, "null"),
+		chunk(`{"tool_calls":[{"function":{"arguments":"\"main.go\"}"},"index":0}]}`, "null"),
+		chunk(`{}`, `"tool_calls"`),
+		"[DONE]",
+	}
+}
+
+// interruptedChunk ends a stream the upstream connection dropped in the middle of
+const interruptedChunk = `{"error":{"message":"The upstream stream ended before the response was complete","type":"server_error","param":null,"code":"stream_interrupted"}}`
+
+func relayedResponse(model, content string) string {
+	return `{"id":"chatcmpl-1","object":"chat.completion","created":1700000000,"model":"` + model + `",` +
+		`"choices":[{"index":0,"message":{"role":"assistant","content":"` + content + `"},"finish_reason":"stop"}],` +
+		`"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`
+}
+
+// openAICases are the cases shared by the OpenAI-compatible variants
+func openAICases(provider, model string) []chatCase {
+	return []chatCase{
+		{
+			name:     "regular response",
+			provider: provider,
+			request:  chatRequest(model, false),
+			replies:  []upstreamReply{openAIResponse("Hello!")},
+			wantBody: relayedResponse(model, "Hello!"),
+			checkUpstream: func(t *testing.T, reqs []upstreamRequest) {
+				if len(reqs) != 1 {
+					t.Fatalf("upstream got %d requests, want 1", len(reqs))
+				}
+				if reqs[0].path != "/v1/chat/completions" {
+					t.Errorf("upstream path = %q", reqs[0].path)
+				}
+				if got := reqs[0].header.Get("Authorization"); got != "Bearer sk-test-upstream-key" {
+					t.Errorf("upstream Authorization = %q", got)
+				}
+				if messages, _ := reqs[0].body["messages"].([]interface{}); len(messages) != 2 {
+					t.Errorf("upstream messages = %v, want the system and user message", reqs[0].body["messages"])
+				}
+			},
+		},
+		{
+			name:       "tool call stream",
+			provider:   provider,
+			request:    toolRequest(model, true),
+			replies:    []upstreamReply{{events: openAIToolStream}},
+			wantChunks: relayedToolStream(model),
+			checkUpstream: func(t *testing.T, reqs []upstreamRequest) {
+				// Usage is always requested so it can be recorded
+				if opts, _ := reqs[0].body["stream_options"].(map[string]interface{}); opts["include_usage"] != true {
+					t.Errorf("upstream stream_options = %v, want include_usage", reqs[0].body["stream_options"])
+				}
+			},
+		},
+		{
+			name:     "usage chunk when requested",
+			provider: provider,
+			request:  strings.Replace(toolRequest(model, true), `"stream":true`, `"stream":true,"stream_options":{"include_usage":true}`, 1),
+			replies:  []upstreamReply{{events: openAIToolStream}},
+			wantChunks: append(relayedToolStream(model)[:5:5],
+				`{"choices":[],"created":0,"id":"chatcmpl-1","model":"`+model+`","object":"chat.completion.chunk","usage":{"completion_tokens":8,"prompt_tokens":20,"total_tokens":28}}`,
+				"[DONE]"),
+		},
+		{
+			name:       "upstream error",
+			provider:   provider,
+			request:    chatRequest(model, false),
+			replies:    []upstreamReply{{status: http.StatusBadRequest, body: `{"error":{"message":"Invalid request","type":"invalid_request_error"}}`}},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"message":"Invalid request","type":"invalid_request_error","param":null,"code":null}}`,
+		},
+		{
+			name:     "context length error",
+			provider: provider,
+			request:  chatRequest(model, false),
+			replies: []upstreamReply{{status: http.StatusBadRequest, body: `{"error":{"message":"This model's maximum context length is 65536 tokens","type":"invalid_request_error","param":null,"code":"invalid_request_error"}}`,
+				header: map[string]string{"X-Upstream-Trace": "abc"}}},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"message":"This model's maximum context length is 65536 tokens","type":"invalid_request_error","param":null,"code":"context_length_exceeded"}}`,
+			wantHeader: map[string]string{"X-Upstream-Trace": ""},
+		},
+		{
+			name:       "insufficient balance",
+			provider:   provider,
+			request:    chatRequest(model, false),
+			replies:    []upstreamReply{{status: http.StatusPaymentRequired, body: `{"error":{"message":"Insufficient Balance","type":"unknown_error","param":null,"code":"invalid_request_error"}}`}},
+			wantStatus: http.StatusPaymentRequired,
+			wantBody:   `{"error":{"message":"Insufficient Balance","type":"insufficient_quota","param":null,"code":"insufficient_quota"}}`,
+		},
+		{
+			name:       "truncated stream",
+			provider:   provider,
+			request:    toolRequest(model, true),
+			replies:    []upstreamReply{{events: openAIToolStream[:3], truncate: true}},
+			wantChunks: append(relayedToolStream(model)[:3:3], interruptedChunk),
+		},
+		{
+			name:     "error chunk mid-stream",
+			provider: provider,
+			request:  toolRequest(model, true),
+			replies: []upstreamReply{{events: append(openAIToolStream[:2:2],
+				dataEvent(`{"error":{"message":"Service busy","type":"server_error","param":null,"code":null}}`),
+			)}},
+			wantChunks: append(relayedToolStream(model)[:2:2], `{"error":{"message":"Service busy","type":"server_error","param":null,"code":null}}`),
+		},
+		{
+			name:     "upstream error type mapped mid-stream",
+			provider: provider,
+			request:  toolRequest(model, true),
+			replies: []upstreamReply{{events: append(openAIToolStream[:2:2],
+				dataEvent(`{"error":{"message":"Rate limit reached","type":"rate_limit_error"}}`),
+			)}},
+			wantChunks: append(relayedToolStream(model)[:2:2], `{"error":{"message":"Rate limit reached","type":"requests","param":null,"code":"rate_limit_exceeded"}}`),
+		},
+	}
+}
+
+func TestDeepSeek(t *testing.T) {
+	runChatCases(t, openAICases("deepseek", "deepseek-chat"))
+}
+
+// reasonerHistory is a follow-up turn replaying a deepseek-reasoner answer
+// with its reasoning_content, which DeepSeek rejects in history
+const reasonerHistory = `{"model":"deepseek-reasoner","stream":%t,"messages":[` +
+	`{"role":"user","content":"What is 2+2?"},` +
+	`{"role":"assistant","content":"4","reasoning_content":"Two plus two is four."},` +
+	`{"role":"user","content":"And 3+3?"}]}`
+
+func TestDeepSeekReasoner(t *testing.T) {
+	stripsReasoning := func(t *testing.T, reqs []upstreamRequest) {
+		messages, _ := reqs[0].body["messages"].([]interface{})
+		if len(messages) != 3 {
+			t.Fatalf("upstream messages = %v, want the whole history", reqs[0].body["messages"])
+		}
+		for _, m := range messages {
+			if _, ok := m.(map[string]interface{})["reasoning_content"]; ok {
+				t.Errorf("upstream message %v still carries reasoning_content", m)
+			}
+		}
+	}
+	runChatCases(t, []chatCase{
+		{
+			name:     "regular response",
+			provider: "deepseek",
+			request:  fmt.Sprintf(reasonerHistory, false),
+			replies: []upstreamReply{{body: `{"id":"chatcmpl-1","object":"chat.completion","created":1700000000,"model":"deepseek-reasoner",` +
+				`"choices":[{"index":0,"message":{"role":"assistant","content":"6","reasoning_content":"Three plus three is six."},"finish_reason":"stop"}],` +
+				`"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`}},
+			wantBody: `{"id":"chatcmpl-1","object":"chat.completion","created":1700000000,"model":"deepseek-reasoner",` +
+				`"choices":[{"index":0,"message":{"role":"assistant","content":"6","reasoning_content":"Three plus three is six."},"finish_reason":"stop"}],` +
+				`"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`,
+			checkUpstream: stripsReasoning,
+		},
+		{
+			name:     "stream",
+			provider: "deepseek",
+			request:  fmt.Sprintf(reasonerHistory, true),
+			replies: []upstreamReply{{events: []string{
+				openAIChunk(`{"role":"assistant","content":null,"reasoning_content":""}`, ""),
+				openAIChunk(`{"content":null,"reasoning_content":"Three plus three"}`, ""),
+				openAIChunk(`{"content":null,"reasoning_content":" is six."}`, ""),
+				openAIChunk(`{"content":"6","reasoning_content":null}`, ""),
+				openAIChunk(`{}`, "stop"),
+				dataEvent(`[DONE]`),
+			}}},
+			wantChunks: []string{
+				`{"choices":[{"delta":{"content":null,"reasoning_content":"","role":"assistant"},"finish_reason":null,"index":0}],"created":0,"id":"chatcmpl-1","model":"deepseek-reasoner","object":"chat.completion.chunk"}`,
+				`{"choices":[{"delta":{"content":null,"reasoning_content":"Three plus three"},"finish_reason":null,"index":0}],"created":0,"id":"chatcmpl-1","model":"deepseek-reasoner","object":"chat.completion.chunk"}`,
+				`{"choices":[{"delta":{"content":null,"reasoning_content":" is six."},"finish_reason":null,"index":0}],"created":0,"id":"chatcmpl-1","model":"deepseek-reasoner","object":"chat.completion.chunk"}`,
+				`{"choices":[{"delta":{"content":"6","reasoning_content":null},"finish_reason":null,"index":0}],"created":0,"id":"chatcmpl-1","model":"deepseek-reasoner","object":"chat.completion.chunk"}`,
+				`{"choices":[{"delta":{},"finish_reason":"stop","index":0}],"created":0,"id":"chatcmpl-1","model":"deepseek-reasoner","object":"chat.completion.chunk"}`,
+				"[DONE]",
+			},
+			checkUpstream: stripsReasoning,
+		},
+	})
+}
+
+func TestPOE(t *testing.T) {
+	runChatCases(t, openAICases("poe", "claude-sonnet-4.5"))
+}
+
+// anthropicToolChunks is anthropicToolStream translated to OpenAI chunks
+var anthropicToolChunks = []string{
+	`{"id":"msg_1","object":"chat.completion.chunk","created":0,"model":"claude-sonnet-4.5","choices":[{"index":0,"delta":{"role":"assistant"},"finish_reason":null}]}`,
+	`{"id":"msg_1","object":"chat.completion.chunk","created":0,"model":"claude-sonnet-4.5","choices":[{"index":0,"delta":{"content":"Reading it."},"finish_reason":null}]}`,
+	`{"id":"msg_1","object":"chat.completion.chunk","created":0,"model":"claude-sonnet-4.5","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"toolu_1","type":"function","function":{"name":"read_file"}}]},"finish_reason":null}]}`,
+	`{"id":"msg_1","object":"chat.completion.chunk","created":0,"model":"claude-sonnet-4.5","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"path\":"}}]},"finish_reason":null}]}`,
+	`{"id":"msg_1","object":"chat.completion.chunk","created":0,"model":"claude-sonnet-4.5","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"main.go\"}"}}]},"finish_reason":null}]}`,
+	`{"id":"msg_1","object":"chat.completion.chunk","created":0,"model":"claude-sonnet-4.5","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+	"[DONE]",
+}
+
+// anthropicCases are the cases shared by the Anthropic variants
+func anthropicCases(provider string) []chatCase {
+	// Without a model config the built-in model maps rename the model
+	wantModel := modelNameMap["claude-sonnet-4.5"]
+	if provider == "o2a-max" {
+		wantModel = cliModelNameMap["claude-sonnet-4.5"]
+	}
+	return []chatCase{
+		{
+			name:     "regular response",
+			provider: provider,
+			request:  chatRequest("claude-sonnet-4.5", false),
+			replies:  []upstreamReply{anthropicResponse("Hello!")},
+			wantBody: `{"id":"msg_1","object":"chat.completion","created":0,"model":"claude-sonnet-4.5",` +
+				`"choices":[{"index":0,"message":{"role":"assistant","content":"Hello!"},"finish_reason":"stop"}],` +
+				`"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`,
+			checkUpstream: func(t *testing.T, reqs []upstreamRequest) {
+				if len(reqs) != 1 {
+					t.Fatalf("upstream got %d requests, want 1", len(reqs))
+				}
+				req := reqs[0]
+				if req.path != "/v1/messages" {
+					t.Errorf("upstream path = %q", req.path)
+				}
+				if got := req.header.Get("x-api-key"); got != "sk-test-upstream-key" {
+					t.Errorf("upstream x-api-key = %q", got)
+				}
+				if req.body["model"] != wantModel {
+					t.Errorf("upstream model = %v, want %s", req.body["model"], wantModel)
+				}
+				if req.body["system"] != "Be brief." {
+					t.Errorf("upstream system = %v, want the system message hoisted", req.body["system"])
+				}
+				if messages, _ := req.body["messages"].([]interface{}); len(messages) != 1 {
+					t.Errorf("upstream messages = %v, want only the user message", req.body["messages"])
+				}
+			},
+		},
+		{
+			name:       "tool call stream",
+			provider:   provider,
+			request:    toolRequest("claude-sonnet-4.5", true),
+			replies:    []upstreamReply{{events: anthropicToolStream}},
+			wantChunks: anthropicToolChunks,
+			checkUpstream: func(t *testing.T, reqs []upstreamRequest) {
+				tools, _ := reqs[0].body["tools"].([]interface{})
+				if len(tools) != 1 {
+					t.Fatalf("upstream tools = %v", reqs[0].body["tools"])
+				}
+				tool, _ := tools[0].(map[string]interface{})
+				if tool["name"] != "read_file" || tool["input_schema"] == nil {
+					t.Errorf("upstream tool = %v, want an Anthropic tool with input_schema", tool)
+				}
+			},
+		},
+		{
+			name:     "usage chunk when requested",
+			provider: provider,
+			request:  strings.Replace(toolRequest("claude-sonnet-4.5", true), `"stream":true`, `"stream":true,"stream_options":{"include_usage":true}`, 1),
+			replies:  []upstreamReply{{events: anthropicToolStream}},
+			wantChunks: append(anthropicToolChunks[:6:6],
+				`{"id":"msg_1","object":"chat.completion.chunk","created":0,"model":"claude-sonnet-4.5","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":8,"total_tokens":28}}`,
+				"[DONE]"),
+		},
+		{
+			name:       "upstream error",
+			provider:   provider,
+			request:    chatRequest("claude-sonnet-4.5", true),
+			replies:    []upstreamReply{anthropicRateLimit},
+			wantStatus: http.StatusTooManyRequests,
+			wantBody:   `{"error":{"message":"Number of requests has exceeded your rate limit","type":"requests","param":null,"code":"rate_limit_exceeded"}}`,
+			wantHeader: map[string]string{"Retry-After": "7", "Content-Type": "application/json", "anthropic-ratelimit-requests-reset": ""},
+		},
+		{
+			name:       "overloaded",
+			provider:   provider,
+			request:    chatRequest("claude-sonnet-4.5", false),
+			replies:    []upstreamReply{{status: 529, body: `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`}},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   `{"error":{"message":"Overloaded","type":"server_error","param":null,"code":"overloaded"}}`,
+		},
+		{
+			name:       "authentication error",
+			provider:   provider,
+			request:    chatRequest("claude-sonnet-4.5", false),
+			replies:    []upstreamReply{{status: http.StatusUnauthorized, body: `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`}},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   `{"error":{"message":"invalid x-api-key","type":"invalid_request_error","param":null,"code":"invalid_api_key"}}`,
+		},
+		{
+			name:       "truncated stream",
+			provider:   provider,
+			request:    toolRequest("claude-sonnet-4.5", true),
+			replies:    []upstreamReply{{events: anthropicToolStream[:4], truncate: true}},
+			wantChunks: append(anthropicToolChunks[:2:2], interruptedChunk),
+		},
+		{
+			name:     "error event mid-stream",
+			provider: provider,
+			request:  toolRequest("claude-sonnet-4.5", true),
+			replies: []upstreamReply{{events: append(anthropicToolStream[:4:4],
+				anthropicEvent("error", `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`),
+			)}},
+			wantChunks: append(anthropicToolChunks[:2:2], `{"error":{"message":"Overloaded","type":"server_error","param":null,"code":"overloaded"}}`),
+		},
+	}
+}
+
+func TestO2A(t *testing.T) {
+	runChatCases(t, anthropicCases("o2a"))
+}
+
+func TestO2AMax(t *testing.T) {
+	cases := anthropicCases("o2a-max")
+	cases = append(cases, chatCase{
+		name:       "Claude CLI headers",
+		provider:   "o2a-max",
+		request:    chatRequest("claude-sonnet-4.5", true),
+		replies:    []upstreamReply{{events: anthropicToolStream}},
+		wantChunks: anthropicToolChunks,
+		checkUpstream: func(t *testing.T, reqs []upstreamRequest) {
+			h := reqs[0].header
+			if ua := h.Get("User-Agent"); !strings.HasPrefix(ua, "claude-cli/") {
+				t.Errorf("upstream User-Agent = %q, want the Claude CLI", ua)
+			}
+			if h.Get("x-app") != "cli" || h.Get("accept") != "text/event-stream" {
+				t.Errorf("upstream headers = %v", h)
+			}
+		},
+	})
+	runChatCases(t, cases)
+}
+
+func TestClientDisconnectClosesUpstream(t *testing.T) {
+	cases := []struct {
+		provider string
+		model    string
+		events   []string
+	}{
+		{"deepseek", "deepseek-chat", openAIToolStream[:2]},
+		{"poe", "claude-sonnet-4.5", openAIToolStream[:2]},
+		{"o2a", "claude-sonnet-4.5", anthropicToolStream[:4]},
+	}
+	for _, tc := range cases {
+		t.Run(tc.provider, func(t *testing.T) {
+			upstream := newMockUpstream(t, upstreamReply{events: tc.events, hold: true})
+			useProvider(t, tc.provider, upstream.URL)
+
+			// Stop the generation once the upstream has started streaming
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				<-upstream.holding
+				cancel()
+			}()
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(toolRequest(tc.model, true))).WithContext(ctx)
+			rec := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				proxyHandler(rec, req)
+				close(done)
+			}()
+
+			select {
+			case <-upstream.released:
+			case <-time.After(5 * time.Second):
+				t.Fatal("upstream connection still open after the client disconnected")
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("proxyHandler still running after the client disconnected")
+			}
+			if strings.Contains(rec.Body.String(), "[DONE]") {
+				t.Errorf("cancelled stream ended with [DONE]: %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestHeartbeats(t *testing.T) {
+	old := heartbeatInterval
+	t.Cleanup(func() { heartbeatInterval = old })
+	heartbeatInterval = 10 * time.Millisecond
+
+	cases := []struct {
+		provider string
+		model    string
+		events   []string
+	}{
+		{"deepseek", "deepseek-chat", openAIToolStream[:2]},
+		{"poe", "claude-sonnet-4.5", openAIToolStream[:2]},
+		{"o2a", "claude-sonnet-4.5", anthropicToolStream[:2]},
+	}
+	for _, tc := range cases {
+		t.Run(tc.provider, func(t *testing.T) {
+			upstream := newMockUpstream(t, upstreamReply{events: tc.events, hold: true})
+			useProvider(t, tc.provider, upstream.URL)
+			proxy := httptest.NewServer(http.HandlerFunc(proxyHandler))
+			defer proxy.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(toolRequest(tc.model, true)))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// The upstream goes silent after its first events
+			var seen []string
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				line := scanner.Text()
+				seen = append(seen, line)
+				if line == ": ping" {
+					return
+				}
+			}
+			t.Fatalf("no heartbeat while the upstream was silent, got %q (%v)", seen, scanner.Err())
+		})
+	}
+}
+
+func TestAnthropicPingForwarded(t *testing.T) {
+	old := heartbeatInterval
+	t.Cleanup(func() { heartbeatInterval = old })
+	heartbeatInterval = 0
+
+	upstream := newMockUpstream(t, upstreamReply{events: anthropicToolStream})
+	useProvider(t, "o2a", upstream.URL)
+	rec := postChat(t, toolRequest("claude-sonnet-4.5", true))
+	if n := strings.Count(rec.Body.String(), heartbeatComment); n != 1 {
+		t.Errorf("response has %d heartbeats, want the upstream ping forwarded once: %s", n, rec.Body)
+	}
+}
+
+func TestUpstreamIdleTimeout(t *testing.T) {
+	cfg := defaultTransportConfig()
+	cfg.idleTimeout = 50 * time.Millisecond
+	useUpstreamClient(t, cfg)
+
+	runChatCases(t, []chatCase{
+		{
+			name:       "deepseek",
+			provider:   "deepseek",
+			request:    toolRequest("deepseek-chat", true),
+			replies:    []upstreamReply{{events: openAIToolStream[:2], hold: true}},
+			wantChunks: append(relayedToolStream("deepseek-chat")[:2:2], interruptedChunk),
+		},
+		{
+			name:       "o2a",
+			provider:   "o2a",
+			request:    toolRequest("claude-sonnet-4.5", true),
+			replies:    []upstreamReply{{events: anthropicToolStream[:4], hold: true}},
+			wantChunks: append(anthropicToolChunks[:2:2], interruptedChunk),
+		},
+	})
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	var proxied []string
+	var mu sync.Mutex
+	forward := &httputil.ReverseProxy{Rewrite: func(pr *httputil.ProxyRequest) {
+		mu.Lock()
+		proxied = append(proxied, pr.In.URL.String())
+		mu.Unlock()
+		pr.Out.URL = pr.In.URL
+	}}
+	proxy := httptest.NewServer(forward)
+	defer proxy.Close()
+
+	cfg := defaultTransportConfig()
+	cfg.proxy, _ = url.Parse(proxy.URL)
+	useUpstreamClient(t, cfg)
+
+	runChatCases(t, []chatCase{{
+		name:     "o2a",
+		provider: "o2a",
+		request:  chatRequest("claude-sonnet-4.5", false),
+		replies:  []upstreamReply{anthropicResponse("Hello!")},
+		wantBody: `{"id":"msg_1","object":"chat.completion","created":0,"model":"claude-sonnet-4.5",` +
+			`"choices":[{"index":0,"message":{"role":"assistant","content":"Hello!"},"finish_reason":"stop"}],` +
+			`"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`,
+	}})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(proxied) != 1 || !strings.HasSuffix(proxied[0], "/v1/messages") {
+		t.Errorf("proxy saw %q, want the upstream request", proxied)
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	cases := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "unknown path",
+			path:       "/v1/completions",
+			body:       chatRequest("deepseek-chat", false),
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":{"message":"Invalid URL (POST /v1/completions)","type":"invalid_request_error","param":null,"code":null}}`,
+		},
+		{
+			name:       "invalid JSON",
+			path:       "/v1/chat/completions",
+			body:       `{"model":`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"message":"We could not parse the JSON body of your request: unexpected end of JSON input","type":"invalid_request_error","param":null,"code":null}}`,
+		},
+		{
+			name:       "upstream unreachable",
+			path:       "/v1/chat/completions",
+			body:       chatRequest("deepseek-chat", false),
+			wantStatus: http.StatusBadGateway,
+			wantBody:   `{"error":{"message":"Error forwarding the request to the upstream","type":"server_error","param":null,"code":"upstream_unreachable"}}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useProvider(t, "deepseek", closed.URL)
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			rec := httptest.NewRecorder()
+			proxyHandler(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			if got, want := canonicalJSON(t, rec.Body.String()), canonicalJSON(t, tc.wantBody); got != want {
+				t.Errorf("body:\n got: %s\nwant: %s", got, want)
+			}
+		})
+	}
+}
+
+func TestFallback(t *testing.T) {
+	overloaded := upstreamReply{status: 529, body: `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`}
+	tests := []struct {
+		name           string
+		on             []string
+		anthropicReply upstreamReply
+		// wantFallback is set when the request must be served by deepseek-chat
+		wantFallback bool
+		wantStatus   int
+	}{
+		{name: "overloaded falls back", on: []string{triggerOverloaded}, anthropicReply: overloaded, wantFallback: true, wantStatus: http.StatusOK},
+		{name: "all triggers", anthropicReply: overloaded, wantFallback: true, wantStatus: http.StatusOK},
+		{name: "trigger not listed", on: []string{triggerRateLimit}, anthropicReply: overloaded, wantStatus: http.StatusServiceUnavailable},
+		{
+			name:           "bad request never falls back",
+			anthropicReply: upstreamReply{status: http.StatusBadRequest, body: `{"type":"error","error":{"type":"invalid_request_error","message":"messages: field required"}}`},
+			wantStatus:     http.StatusBadRequest,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			anthropic := newMockUpstream(t, tc.anthropicReply)
+			var deepseekReplies []upstreamReply
+			if tc.wantFallback {
+				deepseekReplies = append(deepseekReplies, openAIResponse("Hello from DeepSeek"))
+			}
+			deepseek := newMockUpstream(t, deepseekReplies...)
+			useRoutes(t,
+				route{pattern: "claude-*", provider: testProvider(t, "o2a", anthropic.URL)},
+				route{pattern: "deepseek-*", provider: testProvider(t, "deepseek", deepseek.URL)},
+			)
+			useModelConfig(t, &modelConfig{Fallbacks: []fallbackRule{{Model: "claude-*", To: []string{"deepseek-chat"}, On: tc.on}}})
+
+			rec := postChat(t, chatRequest("claude-opus-4.6", false))
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d; body: %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+			if got := len(anthropic.received()); got != 1 {
+				t.Errorf("anthropic upstream got %d requests, want 1", got)
+			}
+			reqs := deepseek.received()
+			if !tc.wantFallback {
+				if len(reqs) != 0 {
+					t.Errorf("deepseek upstream got %d requests, want none", len(reqs))
+				}
+				if got := rec.Header().Get("X-Served-Model"); got == "deepseek-chat" {
+					t.Errorf("X-Served-Model = %q without a fallback", got)
+				}
+				return
+			}
+			if len(reqs) != 1 || reqs[0].body["model"] != "deepseek-chat" {
+				t.Fatalf("deepseek upstream requests = %+v, want one for deepseek-chat", reqs)
+			}
+			if got := rec.Header().Get("X-Served-Model"); got != "deepseek-chat" {
+				t.Errorf("X-Served-Model = %q, want deepseek-chat", got)
+			}
+			if !strings.Contains(rec.Body.String(), "Hello from DeepSeek") {
+				t.Errorf("body = %s, want the fallback answer", rec.Body)
+			}
+		})
+	}
+}
+
+// useClients switches to an auth mode for the rest of the test, loading the
+// clients file content in tokens mode
+func useClients(t *testing.T, mode, clientsYAML string) {
+	t.Helper()
+	oldMode, oldClients := authMode, clientsByToken
+	t.Cleanup(func() { authMode, clientsByToken = oldMode, oldClients })
+	authMode, clientsByToken = mode, map[string]*proxyClient{}
+	if clientsYAML == "" {
+		return
+	}
+	path := filepath.Join(t.TempDir(), "clients.yaml")
+	if err := os.WriteFile(path, []byte(clientsYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadClients(path); err != nil {
+		t.Fatalf("loadClients: %v", err)
+	}
+}
+
+// postChatWithToken sends a chat completion request with a Bearer token
+func postChatWithToken(t *testing.T, body, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, req)
+	return rec
+}
+
+func TestClientAuth(t *testing.T) {
+	const clients = `
+clients:
+  - token: sk-proxy-alice-0123456789
+    user: alice
+  - token: sk-proxy-bob-0123456789
+    user: bob
+    keys:
+      deepseek: sk-bob-own-deepseek-key
+`
+	tests := []struct {
+		name  string
+		mode  string
+		token string
+		// wantKey is the upstream Authorization, "" when the request must be
+		// rejected with wantBody
+		wantKey  string
+		wantBody string
+	}{
+		{
+			name:     "unknown token",
+			mode:     authModeTokens,
+			token:    "sk-proxy-mallory-0123456789",
+			wantBody: `{"error":{"message":"Incorrect API key provided: sk-p...6789","type":"invalid_request_error","param":null,"code":"invalid_api_key"}}`,
+		},
+		{
+			name:     "missing token",
+			mode:     authModeTokens,
+			wantBody: `{"error":{"message":"API key required: provide your proxy token as the Bearer token","type":"invalid_request_error","param":null,"code":"missing_api_key"}}`,
+		},
+		{name: "client token uses the server key pool", mode: authModeTokens, token: "sk-proxy-alice-0123456789", wantKey: "Bearer sk-test-upstream-key"},
+		{name: "client with its own upstream key", mode: authModeTokens, token: "sk-proxy-bob-0123456789", wantKey: "Bearer sk-bob-own-deepseek-key"},
+		{name: "passthrough forwards the client key", mode: authModePassthrough, token: "sk-client-own-key", wantKey: "Bearer sk-client-own-key"},
+		{
+			name:     "passthrough without a key",
+			mode:     authModePassthrough,
+			wantBody: `{"error":{"message":"API key required: provide your upstream API key as the Bearer token","type":"invalid_request_error","param":null,"code":"missing_api_key"}}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var replies []upstreamReply
+			if tc.wantKey != "" {
+				replies = append(replies, openAIResponse("Hello!"))
+			}
+			upstream := newMockUpstream(t, replies...)
+			useProvider(t, "deepseek", upstream.URL)
+			clientsYAML := ""
+			if tc.mode == authModeTokens {
+				clientsYAML = clients
+			}
+			useClients(t, tc.mode, clientsYAML)
+
+			rec := postChatWithToken(t, chatRequest("deepseek-chat", false), tc.token)
+
+			reqs := upstream.received()
+			if tc.wantKey == "" {
+				if rec.Code != http.StatusUnauthorized {
+					t.Errorf("status = %d, want 401", rec.Code)
+				}
+				if got, want := canonicalJSON(t, rec.Body.String()), canonicalJSON(t, tc.wantBody); got != want {
+					t.Errorf("body:\n got: %s\nwant: %s", got, want)
+				}
+				if len(reqs) != 0 {
+					t.Errorf("upstream got %d requests, want none", len(reqs))
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+			}
+			if len(reqs) != 1 {
+				t.Fatalf("upstream got %d requests, want 1", len(reqs))
+			}
+			if got := reqs[0].header.Get("Authorization"); got != tc.wantKey {
+				t.Errorf("upstream Authorization = %q, want %q", got, tc.wantKey)
+			}
+		})
+	}
+}
+
+// anthropicThinkingStream is an extended thinking turn ending in a tool call
+var anthropicThinkingStream = []string{
+	anthropicEvent("message_start", `{"type":"message_start","message":{"id":"msg_2","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[],"stop_reason":null,"usage":{"input_tokens":30,"output_tokens":1}}}`),
+	anthropicEvent("content_block_start", `{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`),
+	anthropicEvent("content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"The user wants main.go."}}`),
+	anthropicEvent("content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":" I should read it."}}`),
+	anthropicEvent("content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"EqQBCkYIARgCsig"}}`),
+	anthropicEvent("content_block_stop", `{"type":"content_block_stop","index":0}`),
+	anthropicEvent("content_block_start", `{"type":"content_block_start","index":1,"content_block":{"type":"redacted_thinking","data":"EmwKAhgBEgy3va"}}`),
+	anthropicEvent("content_block_stop", `{"type":"content_block_stop","index":1}`),
+	anthropicEvent("content_block_start", `{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_think_1","name":"read_file","input":{}}}`),
+	anthropicEvent("content_block_delta", `{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"path\":\"main.go\"}"}}`),
+	anthropicEvent("content_block_stop", `{"type":"content_block_stop","index":2}`),
+	anthropicEvent("message_delta", `{"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":40}}`),
+	anthropicEvent("message_stop", `{"type":"message_stop"}`),
+}
+
+func TestAnthropicThinking(t *testing.T) {
+	upstream := newMockUpstream(t, upstreamReply{events: anthropicThinkingStream}, anthropicResponse("It is the entry point."))
+	useProvider(t, "o2a", upstream.URL)
+
+	// First turn: thinking is streamed as reasoning_content
+	rec := postChat(t, strings.Replace(toolRequest("claude-sonnet-4.5", true), `"stream":true`, `"stream":true,"reasoning_effort":"medium"`, 1))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+	}
+	var reasoning strings.Builder
+	for _, data := range sseData(rec.Body.String()) {
+		var chunk OAIStreamChunk
+		if data == "[DONE]" || json.Unmarshal([]byte(data), &chunk) != nil || len(chunk.Choices) == 0 {
+			continue
+		}
+		reasoning.WriteString(chunk.Choices[0].Delta.ReasoningContent)
+	}
+	if got := reasoning.String(); got != "The user wants main.go. I should read it." {
+		t.Errorf("reasoning_content = %q, want the thinking text", got)
+	}
+
+	// Second turn: the signed thinking blocks are replayed before the tool call
+	rec = postChat(t, `{"model":"claude-sonnet-4.5","reasoning_effort":"medium","messages":[`+
+		`{"role":"user","content":"Read main.go"},`+
+		`{"role":"assistant","content":null,"reasoning_content":"The user wants main.go. I should read it.",`+
+		`"tool_calls":[{"id":"toolu_think_1","type":"function","function":{"name":"read_file","arguments":"{\"path\":\"main.go\"}"}}]},`+
+		`{"role":"tool","tool_call_id":"toolu_think_1","content":"package main"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("second turn status = %d; body: %s", rec.Code, rec.Body)
+	}
+
+	reqs := upstream.received()
+	if len(reqs) != 2 {
+		t.Fatalf("upstream got %d requests, want 2", len(reqs))
+	}
+	for i, req := range reqs {
+		if thinking, _ := req.body["thinking"].(map[string]interface{}); thinking["type"] != "enabled" {
+			t.Errorf("request %d thinking = %v, want it enabled from reasoning_effort", i, req.body["thinking"])
+		}
+	}
+	messages, _ := reqs[1].body["messages"].([]interface{})
+	if len(messages) != 3 {
+		t.Fatalf("second turn messages = %v", messages)
+	}
+	assistant := messages[1].(map[string]interface{})
+	content, _ := assistant["content"].([]interface{})
+	got, _ := json.Marshal(content)
+	want := `[{"signature":"EqQBCkYIARgCsig","thinking":"The user wants main.go. I should read it.","type":"thinking"},` +
+		`{"data":"EmwKAhgBEgy3va","type":"redacted_thinking"},` +
+		`{"id":"toolu_think_1","input":{"path":"main.go"},"name":"read_file","type":"tool_use"}]`
+	if string(got) != want {
+		t.Errorf("replayed assistant content:\n got: %s\nwant: %s", got, want)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// OpenAIError is the error object of an OpenAI-style error response
+type OpenAIError struct {
+	Message string      `json:"message"`
+	Type    string      `json:"type"`
+	Param   interface{} `json:"param"`
+	Code    interface{} `json:"code"`
+}
+
+func (e *OpenAIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// writeOpenAIError answers with {"error":{...}} so OpenAI clients such as
+// Cursor can show the message. An empty code is sent as null.
+func writeOpenAIError(w http.ResponseWriter, status int, errType, code, message string) {
+	e := &OpenAIError{Message: message, Type: errType}
+	if code != "" {
+		e.Code = code
+	}
+	writeError(w, status, e)
+}
+
+func writeError(w http.ResponseWriter, status int, e *OpenAIError) {
+	body, _ := json.Marshal(map[string]*OpenAIError{"error": e})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeUpstreamError answers an upstream error response, whose body has been
+// read into body, with the equivalent OpenAI error. Of the upstream headers
+// only Retry-After is passed on.
+func writeUpstreamError(w http.ResponseWriter, resp *http.Response, body []byte) {
+	status, e := upstreamError(resp.StatusCode, body)
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		w.Header().Set("Retry-After", v)
+	}
+	writeError(w, status, e)
+}
+
+// upstreamErrorKinds sorts the error types of Anthropic, DeepSeek and POE,
+// and OpenAI's own, into the kinds of failure below
+var upstreamErrorKinds = map[string]string{
+	"invalid_request_error": "invalid_request",
+	"request_too_large":     "invalid_request",
+	"authentication_error":  "authentication",
+	"permission_error":      "permission",
+	"not_found_error":       "not_found",
+	"rate_limit_error":      "rate_limit",
+	"rate_limit_exceeded":   "rate_limit",
+	"requests":              "rate_limit",
+	"tokens":                "rate_limit",
+	"insufficient_quota":    "insufficient_quota",
+	"insufficient_balance":  "insufficient_quota",
+	"insufficient_credits":  "insufficient_quota",
+	"billing_error":         "insufficient_quota",
+	"overloaded_error":      "overloaded",
+	"timeout_error":         "timeout",
+	"api_error":             "server",
+	"server_error":          "server",
+}
+
+// openAIErrorKinds are the OpenAI type and code of each kind of failure
+var openAIErrorKinds = map[string]struct{ errType, code string }{
+	"invalid_request":    {"invalid_request_error", ""},
+	"authentication":     {"invalid_request_error", "invalid_api_key"},
+	"permission":         {"invalid_request_error", "permission_denied"},
+	"not_found":          {"invalid_request_error", "model_not_found"},
+	"rate_limit":         {"requests", "rate_limit_exceeded"},
+	"insufficient_quota": {"insufficient_quota", "insufficient_quota"},
+	"overloaded":         {"server_error", "overloaded"},
+	"timeout":            {"server_error", "timeout"},
+	"server":             {"server_error", ""},
+}
+
+// errorKindForStatus is the kind of failure of an upstream status whose
+// error type is missing or unknown
+func errorKindForStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication"
+	case status == http.StatusPaymentRequired:
+		return "insufficient_quota"
+	case status == http.StatusForbidden:
+		return "permission"
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return "timeout"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit"
+	case status == http.StatusServiceUnavailable || status == 529:
+		return "overloaded"
+	case status >= 400 && status < 500:
+		return "invalid_request"
+	}
+	return "server"
+}
+
+// upstreamError maps an upstream error response to the status and OpenAI
+// error sent to the client. Anthropic answers {"type":"error","error":{"type",
+// "message"}}; DeepSeek and POE send OpenAI-style bodies with their own types
+// and codes. The upstream status is kept, except Anthropic's 529, which
+// OpenAI clients know as 503.
+func upstreamError(status int, body []byte) (int, *OpenAIError) {
+	var parsed struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	var upstream struct {
+		Message string      `json:"message"`
+		Type    string      `json:"type"`
+		Param   interface{} `json:"param"`
+		Code    interface{} `json:"code"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		if json.Unmarshal(parsed.Error, &upstream) != nil {
+			// Some relays send {"error":"message"}
+			json.Unmarshal(parsed.Error, &upstream.Message)
+		}
+		if upstream.Message == "" {
+			upstream.Message = parsed.Message
+		}
+	} else if text := strings.TrimSpace(string(body)); text != "" && !strings.HasPrefix(text, "<") {
+		// Plain text, but not the HTML page of a gateway
+		upstream.Message = truncateString(text, 500)
+	}
+
+	e := mapUpstreamError(status, upstream.Type, upstream.Message, body)
+	if code, ok := upstream.Code.(string); ok && code != "" && e.Code == nil {
+		e.Code = code
+	}
+	if param, ok := upstream.Param.(string); ok {
+		e.Param = param
+	}
+	if status == 529 {
+		status = http.StatusServiceUnavailable
+	}
+	return status, e
+}
+
+// mapUpstreamError builds the OpenAI error for an upstream error type and
+// message, going by status when the type is unknown; status is 0 for an
+// error event in the middle of a stream
+func mapUpstreamError(status int, upstreamType, message string, body []byte) *OpenAIError {
+	kind, ok := upstreamErrorKinds[upstreamType]
+	if !ok {
+		kind = errorKindForStatus(status)
+	}
+	oe := openAIErrorKinds[kind]
+	e := &OpenAIError{Message: message, Type: oe.errType}
+	if oe.code != "" {
+		e.Code = oe.code
+	}
+	switch {
+	case kind == "invalid_request" && isContextLengthError(http.StatusBadRequest, body):
+		e.Code = "context_length_exceeded"
+	case kind == "invalid_request" && isModelNotFoundError(http.StatusBadRequest, body):
+		e.Code = "model_not_found"
+	case upstreamType == "tokens":
+		e.Type = "tokens"
+	}
+	if e.Message == "" {
+		e.Message = "The upstream returned an error"
+		if text := http.StatusText(status); text != "" {
+			e.Message = fmt.Sprintf("The upstream returned %d %s", status, text)
+		}
+	}
+	return e
+}
+
+// failStream ends a stream the upstream broke off with an error chunk,
+// data: {"error":{...}} and no [DONE], so the client shows the error instead
+// of taking a truncated answer as complete. The error is kept in
+// ur.StreamErr for the request log and metrics.
+func failStream(w http.ResponseWriter, ur *UpstreamRequest, e *OpenAIError) {
+	ur.StreamErr = e
+	data, _ := json.Marshal(map[string]*OpenAIError{"error": e})
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// streamInterrupted is the error sent when the upstream stream ended early;
+// the cause is only logged
+func streamInterrupted() *OpenAIError {
+	return &OpenAIError{Message: "The upstream stream ended before the response was complete", Type: "server_error", Code: "stream_interrupted"}
+}
+
+// openAIStreamError converts the error object of an error chunk in a DeepSeek
+// or POE stream, keeping the upstream code and param like upstreamError; data
+// is the raw chunk
+func openAIStreamError(e map[string]interface{}, data []byte) *OpenAIError {
+	oe := mapUpstreamError(0, getString(e, "type"), getString(e, "message"), data)
+	if code, ok := e["code"].(string); ok && code != "" && oe.Code == nil {
+		oe.Code = code
+	}
+	if param, ok := e["param"].(string); ok {
+		oe.Param = param
+	}
+	return oe
+}
+
+// anthropicStreamError converts the error object of an Anthropic error event
+func anthropicStreamError(e map[string]interface{}) *OpenAIError {
+	return mapUpstreamError(0, getString(e, "type"), getString(e, "message"), nil)
+}
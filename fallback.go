@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Fallback triggers, the failures that move a request on to the next model
+const (
+	triggerNotFound      = "not_found"
+	triggerRateLimit     = "rate_limit"
+	triggerOverloaded    = "overloaded"
+	triggerTimeout       = "timeout"
+	triggerContextLength = "context_length"
+	// triggerUnreachable covers connection failures other than timeouts
+	triggerUnreachable = "unreachable"
+)
+
+var allTriggers = []string{triggerNotFound, triggerRateLimit, triggerOverloaded, triggerTimeout, triggerContextLength, triggerUnreachable}
+
+// fallbackRule sends requests for models matching Model (a glob, as in the
+// routing table) on to the models in To, in order, when the upstream fails
+// with one of the On triggers
+type fallbackRule struct {
+	Model string   `yaml:"model"`
+	To    []string `yaml:"to"`
+	// On lists the triggers; empty means all of them
+	On []string `yaml:"on"`
+}
+
+// defaultFallbacks keeps the DeepSeek behaviour of retrying on the reasoner
+// model when the requested one does not exist or cannot be reached
+var defaultFallbacks = []fallbackRule{
+	{Model: "deepseek-*", To: []string{deepseekReasonerModel}, On: []string{triggerNotFound, triggerUnreachable}},
+}
+
+func (f fallbackRule) validate() error {
+	if f.Model == "" || len(f.To) == 0 {
+		return fmt.Errorf("fallback needs a model pattern and at least one target")
+	}
+	for _, trigger := range f.On {
+		if !containsString(allTriggers, trigger) {
+			return fmt.Errorf("fallback for %q: unknown trigger %q, available: %s", f.Model, trigger, strings.Join(allTriggers, ", "))
+		}
+	}
+	return nil
+}
+
+func (f fallbackRule) triggeredBy(trigger string) bool {
+	return trigger != "" && (len(f.On) == 0 || containsString(f.On, trigger))
+}
+
+// lookupFallback returns the first fallback rule matching a client model name
+func lookupFallback(model string) (fallbackRule, bool) {
+	for _, f := range currentModelConfig().Fallbacks {
+		if matchGlob(f.Model, model) {
+			return f, true
+		}
+	}
+	return fallbackRule{}, false
+}
+
+// fallbackCandidates returns the models to try for a request in order: the
+// requested one, then its fallbacks without repeats
+func fallbackCandidates(model string, f fallbackRule) []string {
+	candidates := []string{model}
+	for _, to := range f.To {
+		if !containsString(candidates, to) {
+			candidates = append(candidates, to)
+		}
+	}
+	return candidates
+}
+
+// forwardWithFallback sends the request as the requested model and, while the
+// upstream fails with a trigger of the matching fallback rule, as each fallback
+// model in turn. When every model fails the last response or error is returned.
+func forwardWithFallback(r *http.Request, body []byte, reqMap map[string]interface{}, requestModel string, client *proxyClient) (*upstreamCall, error) {
+	fallback, _ := lookupFallback(requestModel)
+	candidates := fallbackCandidates(requestModel, fallback)
+
+	logger := logFor(r.Context())
+	var call *upstreamCall
+	var lastErr error
+	for i, model := range candidates {
+		c, err := forwardModel(r, body, reqMap, model, client)
+		if pe, ok := err.(*proxyError); ok {
+			if i == 0 {
+				return nil, pe
+			}
+			// A misconfigured fallback target is skipped
+			logger.Warn("Skipping fallback model", "model", model, "reason", pe.message)
+			continue
+		}
+
+		var trigger string
+		if err != nil {
+			call, lastErr = nil, err
+			if r.Context().Err() != nil {
+				// The client went away; proxyHandler logs that
+				break
+			}
+			trigger = classifyTransportError(err)
+			logger.Warn("Error forwarding model", "model", model, "error", err)
+		} else {
+			call, lastErr = c, nil
+			if c.resp.StatusCode < 400 {
+				break
+			}
+			trigger = classifyErrorResponse(c.resp.StatusCode, c.errBody)
+		}
+		if !fallback.triggeredBy(trigger) || r.Context().Err() != nil {
+			break
+		}
+		if i < len(candidates)-1 {
+			logger.Warn("Model failed, falling back", "model", model, "trigger", trigger, "fallback_model", candidates[i+1])
+			fallbacksTotal.add(1, model, candidates[i+1], trigger)
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return call, nil
+}
+
+// classifyTransportError returns the trigger for a failed upstream round trip
+func classifyTransportError(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return triggerTimeout
+	}
+	return triggerUnreachable
+}
+
+// classifyErrorResponse returns the trigger for an upstream error response,
+// or "" when the failure is not one a fallback can help with
+func classifyErrorResponse(statusCode int, body []byte) string {
+	lower := strings.ToLower(string(body))
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return triggerRateLimit
+	case statusCode == 529 || statusCode == http.StatusServiceUnavailable || (statusCode >= 500 && strings.Contains(lower, "overloaded")):
+		return triggerOverloaded
+	case statusCode == http.StatusGatewayTimeout || statusCode == http.StatusRequestTimeout:
+		return triggerTimeout
+	case isModelNotFoundError(statusCode, body):
+		return triggerNotFound
+	case isContextLengthError(statusCode, body):
+		return triggerContextLength
+	}
+	return ""
+}
+
+// isModelNotFoundError reports whether an upstream error means the model does not exist
+func isModelNotFoundError(statusCode int, body []byte) bool {
+	if statusCode == http.StatusNotFound {
+		return true
+	}
+	if statusCode == http.StatusBadRequest || statusCode == http.StatusUnprocessableEntity {
+		lower := strings.ToLower(string(body))
+		return strings.Contains(lower, "model") &&
+			(strings.Contains(lower, "not found") ||
+				strings.Contains(lower, "not exist") ||
+				strings.Contains(lower, "invalid model") ||
+				strings.Contains(lower, "does not exist") ||
+				strings.Contains(lower, "no such model"))
+	}
+	return false
+}
+
+// isContextLengthError reports whether the upstream rejected the prompt as too
+// long: Anthropic says "prompt is too long", OpenAI-compatible APIs use the
+// context_length_exceeded code or mention the maximum context length
+func isContextLengthError(statusCode int, body []byte) bool {
+	if statusCode != http.StatusBadRequest && statusCode != http.StatusRequestEntityTooLarge {
+		return false
+	}
+	lower := strings.ToLower(string(body))
+	return strings.Contains(lower, "context_length_exceeded") ||
+		strings.Contains(lower, "prompt is too long") ||
+		strings.Contains(lower, "maximum context length") ||
+		strings.Contains(lower, "context window")
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
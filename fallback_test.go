@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClassifyErrorResponse(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusTooManyRequests, `{"error":{"type":"rate_limit_error"}}`, triggerRateLimit},
+		{529, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, triggerOverloaded},
+		{http.StatusServiceUnavailable, ``, triggerOverloaded},
+		{http.StatusInternalServerError, `{"error":{"message":"Server overloaded"}}`, triggerOverloaded},
+		{http.StatusGatewayTimeout, ``, triggerTimeout},
+		{http.StatusNotFound, ``, triggerNotFound},
+		{http.StatusBadRequest, `{"error":{"message":"Model Not Exist"}}`, triggerNotFound},
+		{http.StatusBadRequest, `{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long: 210000 tokens > 200000 maximum"}}`, triggerContextLength},
+		{http.StatusBadRequest, `{"error":{"message":"messages: field required"}}`, ""},
+		{http.StatusUnauthorized, `{"error":{"type":"authentication_error"}}`, ""},
+		{http.StatusInternalServerError, `{"error":{"message":"boom"}}`, ""},
+	}
+	for _, tc := range tests {
+		if got := classifyErrorResponse(tc.status, []byte(tc.body)); got != tc.want {
+			t.Errorf("classifyErrorResponse(%d, %s) = %q, want %q", tc.status, tc.body, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyStrategyRoundRobin       = "round_robin"
+	keyStrategyLeastRateLimited = "least_rate_limited"
+
+	// defaultKeyCooldown rests a rate-limited key that came without retry-after
+	defaultKeyCooldown = time.Minute
+	// keyQuarantine is how long a key rejected with 401/403 is left out before
+	// it is given another chance
+	keyQuarantine = 30 * time.Minute
+)
+
+// keyPool holds the server-side upstream keys of one provider and picks one
+// per request, skipping keys that are cooling down or quarantined
+type keyPool struct {
+	provider string
+	strategy string
+
+	mu   sync.Mutex
+	keys []*poolKey
+	// next is where the round-robin scan starts
+	next int
+}
+
+type poolKey struct {
+	secret string
+
+	cooldownUntil    time.Time
+	quarantinedUntil time.Time
+	lastRateLimited  time.Time
+	requests         int
+	rateLimited      int
+	rejected         int
+	lastStatus       int
+}
+
+// newKeyPool builds a pool from keys, dropping empty and duplicate entries
+func newKeyPool(provider, strategy string, keys []string) *keyPool {
+	pool := &keyPool{provider: provider, strategy: strategy}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == "" || seen[k] {
+			continue
+		}
+		seen[k] = true
+		pool.keys = append(pool.keys, &poolKey{secret: k})
+		registerSecret(k)
+	}
+	return pool
+}
+
+// keyStrategy is the pick strategy of every pool, set from KEY_POOL_STRATEGY in main
+var keyStrategy = keyStrategyRoundRobin
+
+// keyPoolStrategy reads KEY_POOL_STRATEGY
+func keyPoolStrategy() (string, error) {
+	switch v := os.Getenv("KEY_POOL_STRATEGY"); v {
+	case "", keyStrategyRoundRobin:
+		return keyStrategyRoundRobin, nil
+	case keyStrategyLeastRateLimited:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown KEY_POOL_STRATEGY %q, available: %s, %s", v, keyStrategyRoundRobin, keyStrategyLeastRateLimited)
+	}
+}
+
+// splitKeys splits a comma-separated key list
+func splitKeys(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+func (kp *keyPool) size() int {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	return len(kp.keys)
+}
+
+func (k *poolKey) usable(now time.Time) bool {
+	return now.After(k.cooldownUntil) && now.After(k.quarantinedUntil)
+}
+
+// pick returns the key for the next request, or nil when the pool is empty or
+// every key is quarantined. If all keys are cooling down, the one that
+// becomes free first is used.
+func (kp *keyPool) pick() *poolKey {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	now := time.Now()
+	var chosen, soonest *poolKey
+	chosenIdx := 0
+	for i := range kp.keys {
+		idx := (kp.next + i) % len(kp.keys)
+		k := kp.keys[idx]
+		if now.Before(k.quarantinedUntil) {
+			continue
+		}
+		if !k.usable(now) {
+			if soonest == nil || k.cooldownUntil.Before(soonest.cooldownUntil) {
+				soonest = k
+			}
+			continue
+		}
+		if chosen == nil || (kp.strategy == keyStrategyLeastRateLimited && k.lastRateLimited.Before(chosen.lastRateLimited)) {
+			chosen, chosenIdx = k, idx
+			if kp.strategy == keyStrategyRoundRobin {
+				break
+			}
+		}
+	}
+	if chosen != nil {
+		// Ties go round-robin for both strategies
+		kp.next = chosenIdx + 1
+	} else {
+		chosen = soonest
+	}
+	if chosen != nil {
+		chosen.requests++
+	}
+	return chosen
+}
+
+// peek returns the secret pick would choose next without counting a request
+// or advancing the rotation, for side queries such as model lists
+func (kp *keyPool) peek() (string, bool) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	now := time.Now()
+	var soonest *poolKey
+	for i := range kp.keys {
+		k := kp.keys[(kp.next+i)%len(kp.keys)]
+		if k.usable(now) {
+			return k.secret, true
+		}
+		if now.After(k.quarantinedUntil) && (soonest == nil || k.cooldownUntil.Before(soonest.cooldownUntil)) {
+			soonest = k
+		}
+	}
+	if soonest == nil {
+		return "", false
+	}
+	return soonest.secret, true
+}
+
+// hasUsable reports whether a key other than except can be used right now
+func (kp *keyPool) hasUsable(except *poolKey) bool {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	now := time.Now()
+	for _, k := range kp.keys {
+		if k != except && k.usable(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// report updates the health of k from the outcome of a request sent with it
+func (kp *keyPool) report(k *poolKey, resp *http.Response, err error) {
+	if err != nil {
+		return
+	}
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	now := time.Now()
+	k.lastStatus = resp.StatusCode
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		k.rejected++
+		k.quarantinedUntil = now.Add(keyQuarantine)
+		slog.Warn("Upstream rejected key, quarantined", "provider", kp.provider, "key", maskKey(k.secret), "status", resp.StatusCode, "quarantine", keyQuarantine.String())
+	case http.StatusTooManyRequests:
+		cooldown, ok := retryAfter(resp.Header)
+		if !ok {
+			cooldown = defaultKeyCooldown
+		}
+		k.rateLimited++
+		k.lastRateLimited = now
+		k.cooldownUntil = now.Add(cooldown)
+		slog.Warn("Upstream rate limited key, cooling down", "provider", kp.provider, "key", maskKey(k.secret), "cooldown", cooldown.Round(time.Second).String())
+	}
+}
+
+// keyStatus is the admin view of one pooled key; it never carries the secret
+type keyStatus struct {
+	Key              string     `json:"key"`
+	State            string     `json:"state"`
+	CooldownUntil    *time.Time `json:"cooldown_until,omitempty"`
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"`
+	Requests         int        `json:"requests"`
+	RateLimited      int        `json:"rate_limited"`
+	Rejected         int        `json:"rejected"`
+	LastStatus       int        `json:"last_status,omitempty"`
+}
+
+type keyPoolStatus struct {
+	Provider string      `json:"provider"`
+	Strategy string      `json:"strategy"`
+	Keys     []keyStatus `json:"keys"`
+}
+
+func (kp *keyPool) status() keyPoolStatus {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	now := time.Now()
+	out := keyPoolStatus{Provider: kp.provider, Strategy: kp.strategy, Keys: []keyStatus{}}
+	for _, k := range kp.keys {
+		ks := keyStatus{
+			Key:         maskKey(k.secret),
+			State:       "available",
+			Requests:    k.requests,
+			RateLimited: k.rateLimited,
+			Rejected:    k.rejected,
+			LastStatus:  k.lastStatus,
+		}
+		switch {
+		case now.Before(k.quarantinedUntil):
+			until := k.quarantinedUntil
+			ks.State, ks.QuarantinedUntil = "quarantined", &until
+		case now.Before(k.cooldownUntil):
+			until := k.cooldownUntil
+			ks.State, ks.CooldownUntil = "cooling_down", &until
+		}
+		out.Keys = append(out.Keys, ks)
+	}
+	return out
+}
+
+// maskKey shortens a secret to something recognisable but unusable
+func maskKey(key string) string {
+	if len(key) <= 12 {
+		return "****"
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
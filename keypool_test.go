@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keyResponse is an upstream response with a status and headers, for report
+func keyResponse(status int, header ...string) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: http.Header{}}
+	for i := 0; i+1 < len(header); i += 2 {
+		resp.Header.Set(header[i], header[i+1])
+	}
+	return resp
+}
+
+// picks returns the secrets of the next n picks
+func picks(kp *keyPool, n int) []string {
+	var out []string
+	for i := 0; i < n; i++ {
+		if k := kp.pick(); k != nil {
+			out = append(out, k.secret)
+		} else {
+			out = append(out, "<nil>")
+		}
+	}
+	return out
+}
+
+func TestKeyPoolPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		// prepare sets up the key state before picking
+		prepare func(kp *keyPool)
+		want    []string
+	}{
+		{
+			name:     "round robin",
+			strategy: keyStrategyRoundRobin,
+			want:     []string{"key-a", "key-b", "key-c", "key-a"},
+		},
+		{
+			name:     "least rate limited prefers the key limited longest ago",
+			strategy: keyStrategyLeastRateLimited,
+			prepare: func(kp *keyPool) {
+				now := time.Now()
+				kp.keys[0].lastRateLimited = now.Add(-time.Minute)
+				kp.keys[1].lastRateLimited = now.Add(-time.Hour)
+				kp.keys[2].lastRateLimited = now.Add(-2 * time.Minute)
+			},
+			want: []string{"key-b", "key-b", "key-b"},
+		},
+		{
+			name:     "least rate limited ties go round robin",
+			strategy: keyStrategyLeastRateLimited,
+			want:     []string{"key-a", "key-b", "key-c", "key-a"},
+		},
+		{
+			name:     "rejected key is quarantined",
+			strategy: keyStrategyRoundRobin,
+			prepare: func(kp *keyPool) {
+				kp.report(kp.keys[1], keyResponse(http.StatusUnauthorized), nil)
+			},
+			want: []string{"key-a", "key-c", "key-a", "key-c"},
+		},
+		{
+			name:     "rate limited key cools down",
+			strategy: keyStrategyRoundRobin,
+			prepare: func(kp *keyPool) {
+				kp.report(kp.keys[0], keyResponse(http.StatusTooManyRequests, "retry-after", "30"), nil)
+			},
+			want: []string{"key-b", "key-c", "key-b"},
+		},
+		{
+			name:     "all cooling down picks the one free first",
+			strategy: keyStrategyRoundRobin,
+			prepare: func(kp *keyPool) {
+				kp.report(kp.keys[0], keyResponse(http.StatusTooManyRequests, "retry-after", "30"), nil)
+				kp.report(kp.keys[1], keyResponse(http.StatusTooManyRequests, "retry-after", "5"), nil)
+				kp.report(kp.keys[2], keyResponse(http.StatusTooManyRequests), nil)
+			},
+			want: []string{"key-b", "key-b"},
+		},
+		{
+			name:     "all quarantined",
+			strategy: keyStrategyRoundRobin,
+			prepare: func(kp *keyPool) {
+				for _, k := range kp.keys {
+					kp.report(k, keyResponse(http.StatusForbidden), nil)
+				}
+			},
+			want: []string{"<nil>"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			kp := newKeyPool("test", tc.strategy, []string{"key-a", "key-b", "key-c"})
+			if tc.prepare != nil {
+				tc.prepare(kp)
+			}
+			if got := picks(kp, len(tc.want)); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("picks = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKeyPoolReport(t *testing.T) {
+	kp := newKeyPool("test", keyStrategyRoundRobin, []string{"key-a", "key-b", "key-c"})
+	before := time.Now()
+	kp.report(kp.keys[0], keyResponse(http.StatusUnauthorized), nil)
+	kp.report(kp.keys[1], keyResponse(http.StatusTooManyRequests, "retry-after", "7"), nil)
+	kp.report(kp.keys[2], keyResponse(http.StatusTooManyRequests), nil)
+
+	tests := []struct {
+		key   *poolKey
+		until time.Time
+		want  time.Duration
+	}{
+		{kp.keys[0], kp.keys[0].quarantinedUntil, keyQuarantine},
+		{kp.keys[1], kp.keys[1].cooldownUntil, 7 * time.Second},
+		{kp.keys[2], kp.keys[2].cooldownUntil, defaultKeyCooldown},
+	}
+	for _, tc := range tests {
+		if got := tc.until.Sub(before); got < tc.want || got > tc.want+time.Second {
+			t.Errorf("%s rests for %s, want %s", tc.key.secret, got, tc.want)
+		}
+	}
+
+	st := kp.status().Keys
+	if st[0].State != "quarantined" || st[0].Rejected != 1 || st[0].LastStatus != http.StatusUnauthorized {
+		t.Errorf("rejected key status = %+v", st[0])
+	}
+	if st[1].State != "cooling_down" || st[1].RateLimited != 1 || st[1].CooldownUntil == nil {
+		t.Errorf("rate limited key status = %+v", st[1])
+	}
+}
+
+func TestMaskKey(t *testing.T) {
+	tests := []struct{ key, want string }{
+		{"short-key", "****"},
+		{"sk-0123456789abcdef", "sk-0...cdef"},
+	}
+	for _, tc := range tests {
+		if got := maskKey(tc.key); got != tc.want {
+			t.Errorf("maskKey(%q) = %q, want %q", tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestAdminKeysMasked(t *testing.T) {
+	const secret = "sk-admin-test-0123456789"
+	t.Setenv("ADMIN_TOKEN", "admin-token")
+	providersMu.Lock()
+	old := providers
+	providers = map[string]Provider{"deepseek": providerSpecs["deepseek"].newProvider("http://upstream.invalid", newKeyPool("deepseek", keyStrategyRoundRobin, []string{secret}))}
+	providersMu.Unlock()
+	t.Cleanup(func() {
+		providersMu.Lock()
+		providers = old
+		providersMu.Unlock()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/keys", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	rec := httptest.NewRecorder()
+	handleAdminRequest(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	if strings.Contains(body, secret) {
+		t.Errorf("/admin/keys leaks the key: %s", body)
+	}
+	if !strings.Contains(body, maskKey(secret)) {
+		t.Errorf("/admin/keys = %s, want the masked key %s", body, maskKey(secret))
+	}
+}
+
+func TestSendWithRetrySwapsKeys(t *testing.T) {
+	upstream := newMockUpstream(t,
+		upstreamReply{status: http.StatusUnauthorized, body: `{"error":{"message":"Authentication Fails","type":"authentication_error"}}`},
+		openAIResponse("Hello!"),
+	)
+	pool := newKeyPool("deepseek", keyStrategyRoundRobin, []string{"sk-test-key-one", "sk-test-key-two"})
+	useRoutes(t, route{pattern: "*", provider: providerSpecs["deepseek"].newProvider(upstream.URL, pool)})
+	upstreamRetry = retryPolicy{maxRetries: 2, baseDelay: time.Millisecond}
+
+	rec := postChat(t, chatRequest("deepseek-chat", false))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+	}
+	reqs := upstream.received()
+	if len(reqs) != 2 {
+		t.Fatalf("upstream got %d requests, want 2", len(reqs))
+	}
+	for i, want := range []string{"Bearer sk-test-key-one", "Bearer sk-test-key-two"} {
+		if got := reqs[i].header.Get("Authorization"); got != want {
+			t.Errorf("request %d Authorization = %q, want %q", i, got, want)
+		}
+	}
+	if st := pool.status().Keys[0]; st.State != "quarantined" {
+		t.Errorf("rejected key state = %s, want quarantined", st.State)
+	}
+}
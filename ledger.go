@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageEntry is one finished chat completion request, a line of the ledger
+type usageEntry struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id"`
+	User           string    `json:"user"`
+	RequestedModel string    `json:"requested_model"`
+	// ServedModel and Provider are empty when no upstream was reached
+	ServedModel      string `json:"served_model,omitempty"`
+	Provider         string `json:"provider,omitempty"`
+	Stream           bool   `json:"stream"`
+	Status           int    `json:"status"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	CacheReadTokens  int    `json:"cache_read_tokens"`
+	CacheWriteTokens int    `json:"cache_write_tokens"`
+	LatencyMs        int64  `json:"latency_ms"`
+}
+
+// usageLedger appends every finished request to a JSONL file
+type usageLedger struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// ledger is opened in main when USAGE_LEDGER is set; nil disables recording
+var ledger *usageLedger
+
+func openUsageLedger(path string) (*usageLedger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Recording usage", "path", path)
+	return &usageLedger{path: path, file: f}, nil
+}
+
+func (l *usageLedger) append(e usageEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Error writing usage ledger", "error", err)
+	}
+}
+
+// entries reads the ledger entries from the UTC days from to to, inclusive.
+// Lines that cannot be parsed, such as one cut short by a crash, are skipped.
+func (l *usageLedger) entries(from, to string) ([]usageEntry, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []usageEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e usageEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		day := e.Time.UTC().Format("2006-01-02")
+		if (from != "" && day < from) || (to != "" && day > to) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out, scanner.Err()
+}
+
+// recordRequest adds a finished chat completion request to the ledger. call is
+// nil when the request failed before reaching an upstream.
+func recordRequest(requestID string, client *proxyClient, requestModel string, call *upstreamCall, status int, latency time.Duration) {
+	if ledger == nil {
+		return
+	}
+	if status == 0 {
+		// Nothing was written, which net/http answers with 200
+		status = http.StatusOK
+	}
+	e := usageEntry{
+		Time:           time.Now().UTC(),
+		RequestID:      requestID,
+		User:           client.User,
+		RequestedModel: requestModel,
+		Status:         status,
+		LatencyMs:      latency.Milliseconds(),
+	}
+	if call != nil {
+		e.ServedModel = call.servedModel
+		e.Provider = call.provider.Name()
+		e.Stream = call.ur.Stream
+		if u := call.ur.Usage; u != nil {
+			e.PromptTokens = u.PromptTokens
+			e.CompletionTokens = u.CompletionTokens
+			e.CacheReadTokens = u.cachedTokens()
+			e.CacheWriteTokens = u.CacheWriteTokens
+		}
+	}
+	ledger.append(e)
+}
+
+// modelPrice is the USD cost per million tokens of the models matching Model,
+// a glob as in the routing table. Cache prices default to the input price.
+type modelPrice struct {
+	Model      string   `yaml:"model"`
+	Input      float64  `yaml:"input"`
+	Output     float64  `yaml:"output"`
+	CacheRead  *float64 `yaml:"cache_read"`
+	CacheWrite *float64 `yaml:"cache_write"`
+}
+
+// lookupPrice returns the first price entry matching a model
+func lookupPrice(model string) (modelPrice, bool) {
+	for _, p := range currentModelConfig().Prices {
+		if matchGlob(p.Model, model) {
+			return p, true
+		}
+	}
+	return modelPrice{}, false
+}
+
+// cost estimates the USD cost of the tokens in a usage row
+func (p modelPrice) cost(r *usageRow) float64 {
+	cacheRead, cacheWrite := p.Input, p.Input
+	if p.CacheRead != nil {
+		cacheRead = *p.CacheRead
+	}
+	if p.CacheWrite != nil {
+		cacheWrite = *p.CacheWrite
+	}
+	uncached := r.PromptTokens - r.CacheReadTokens - r.CacheWriteTokens
+	return (float64(uncached)*p.Input +
+		float64(r.CacheReadTokens)*cacheRead +
+		float64(r.CacheWriteTokens)*cacheWrite +
+		float64(r.CompletionTokens)*p.Output) / 1e6
+}
+
+// usageRow is the usage of one group in the /admin/usage report; the grouping
+// fields that are not selected stay empty
+type usageRow struct {
+	Day              string  `json:"day,omitempty"`
+	User             string  `json:"user,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Requests         int     `json:"requests"`
+	Errors           int     `json:"errors"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CacheReadTokens  int     `json:"cache_read_tokens"`
+	CacheWriteTokens int     `json:"cache_write_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+func (r *usageRow) add(o *usageRow) {
+	r.Requests += o.Requests
+	r.Errors += o.Errors
+	r.PromptTokens += o.PromptTokens
+	r.CompletionTokens += o.CompletionTokens
+	r.CacheReadTokens += o.CacheReadTokens
+	r.CacheWriteTokens += o.CacheWriteTokens
+	r.CostUSD += o.CostUSD
+}
+
+var usageGroupings = []string{"day", "user", "model"}
+
+// aggregateUsage sums ledger entries by the selected groupings. Each entry is
+// priced on its served model, or the requested one when none was served;
+// models without a price are listed in unpriced and cost nothing.
+func aggregateUsage(entries []usageEntry, groupBy []string) (rows []*usageRow, total *usageRow, unpriced []string) {
+	groups := map[usageRow]*usageRow{}
+	missing := map[string]bool{}
+	total = &usageRow{}
+	for _, e := range entries {
+		model := firstNonEmpty(e.ServedModel, e.RequestedModel)
+		row := &usageRow{
+			Requests:         1,
+			PromptTokens:     e.PromptTokens,
+			CompletionTokens: e.CompletionTokens,
+			CacheReadTokens:  e.CacheReadTokens,
+			CacheWriteTokens: e.CacheWriteTokens,
+		}
+		if e.Status >= 400 {
+			row.Errors = 1
+		}
+		if price, ok := lookupPrice(model); ok {
+			row.CostUSD = price.cost(row)
+		} else if e.PromptTokens > 0 || e.CompletionTokens > 0 {
+			missing[model] = true
+		}
+
+		var key usageRow
+		if containsString(groupBy, "day") {
+			key.Day = e.Time.UTC().Format("2006-01-02")
+		}
+		if containsString(groupBy, "user") {
+			key.User = e.User
+		}
+		if containsString(groupBy, "model") {
+			key.Model = model
+		}
+		g, ok := groups[key]
+		if !ok {
+			g = &usageRow{Day: key.Day, User: key.User, Model: key.Model}
+			groups[key] = g
+			rows = append(rows, g)
+		}
+		g.add(row)
+		total.add(row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		return a.Model < b.Model
+	})
+	for model := range missing {
+		unpriced = append(unpriced, model)
+	}
+	sort.Strings(unpriced)
+	return rows, total, unpriced
+}
+
+// handleUsageReport serves /admin/usage, the ledger aggregated by day, user
+// and model. Query parameters: from and to (YYYY-MM-DD, UTC, inclusive), user
+// to select one user and group_by to choose the groupings.
+func handleUsageReport(w http.ResponseWriter, r *http.Request) {
+	if ledger == nil {
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "", "Usage ledger disabled, set USAGE_LEDGER to enable it")
+		return
+	}
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	for _, day := range []string{from, to} {
+		if _, err := time.Parse("2006-01-02", day); day != "" && err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", fmt.Sprintf("Invalid date %q, expected YYYY-MM-DD", day))
+			return
+		}
+	}
+	groupBy := usageGroupings
+	if v := q.Get("group_by"); v != "" {
+		groupBy = strings.Split(v, ",")
+		for _, g := range groupBy {
+			if !containsString(usageGroupings, g) {
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", fmt.Sprintf("Invalid group_by %q, available: %s", g, strings.Join(usageGroupings, ", ")))
+				return
+			}
+		}
+	}
+
+	entries, err := ledger.entries(from, to)
+	if err != nil {
+		logFor(r.Context()).Error("Error reading usage ledger", "error", err)
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "", "Error reading usage ledger")
+		return
+	}
+	if user := q.Get("user"); user != "" {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.User == user {
+				kept = append(kept, e)
+			}
+		}
+		entries = kept
+	}
+
+	rows, total, unpriced := aggregateUsage(entries, groupBy)
+	if rows == nil {
+		rows = []*usageRow{}
+	}
+	writeJSON(w, map[string]interface{}{
+		"from":            from,
+		"to":              to,
+		"group_by":        groupBy,
+		"rows":            rows,
+		"total":           total,
+		"unpriced_models": unpriced,
+	})
+}
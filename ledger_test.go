@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestModelPriceCost(t *testing.T) {
+	tests := []struct {
+		name  string
+		price modelPrice
+		row   usageRow
+		want  float64
+	}{
+		{
+			name:  "input and output",
+			price: modelPrice{Input: 3, Output: 15},
+			row:   usageRow{PromptTokens: 1_000_000, CompletionTokens: 100_000},
+			want:  3 + 1.5,
+		},
+		{
+			name:  "cache prices",
+			price: modelPrice{Input: 3, Output: 15, CacheRead: floatPtr(0.3), CacheWrite: floatPtr(3.75)},
+			row:   usageRow{PromptTokens: 1_000_000, CacheReadTokens: 600_000, CacheWriteTokens: 200_000, CompletionTokens: 10_000},
+			want:  0.2*3 + 0.6*0.3 + 0.2*3.75 + 0.01*15,
+		},
+		{
+			name:  "cache tokens default to the input price",
+			price: modelPrice{Input: 2, Output: 8},
+			row:   usageRow{PromptTokens: 500_000, CacheReadTokens: 400_000, CacheWriteTokens: 100_000},
+			want:  1,
+		},
+		{
+			name:  "free model",
+			price: modelPrice{},
+			row:   usageRow{PromptTokens: 1000, CompletionTokens: 1000},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.price.cost(&tc.row); math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("cost = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAggregateUsage(t *testing.T) {
+	useModelConfig(t, &modelConfig{Prices: []modelPrice{
+		{Model: "claude-*", Input: 3, Output: 15, CacheRead: floatPtr(0.3)},
+		{Model: "deepseek-chat", Input: 0.27, Output: 1.1},
+	}})
+	day1 := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	entries := []usageEntry{
+		{Time: day1, User: "alice", RequestedModel: "opus", ServedModel: "claude-sonnet-4-6", Status: 200, PromptTokens: 1_000_000, CacheReadTokens: 500_000, CompletionTokens: 100_000},
+		{Time: day1, User: "bob", RequestedModel: "deepseek-chat", ServedModel: "deepseek-chat", Status: 200, PromptTokens: 1_000_000, CompletionTokens: 1_000_000},
+		{Time: day2, User: "alice", RequestedModel: "deepseek-chat", ServedModel: "deepseek-chat", Status: 200, PromptTokens: 2_000_000},
+		// Failed before reaching an upstream: priced on the requested model
+		{Time: day2, User: "bob", RequestedModel: "claude-opus-4.6", Status: 429},
+		{Time: day2, User: "bob", RequestedModel: "mystery", ServedModel: "mystery-1", Status: 200, PromptTokens: 10, CompletionTokens: 10},
+	}
+	claudeCost := 0.5*3 + 0.5*0.3 + 0.1*15
+	bobDeepSeekCost := 0.27 + 1.1
+	aliceDeepSeekCost := 2 * 0.27
+
+	tests := []struct {
+		groupBy []string
+		want    []usageRow
+	}{
+		{
+			groupBy: []string{"user"},
+			want: []usageRow{
+				{User: "alice", Requests: 2, PromptTokens: 3_000_000, CacheReadTokens: 500_000, CompletionTokens: 100_000, CostUSD: claudeCost + aliceDeepSeekCost},
+				{User: "bob", Requests: 3, Errors: 1, PromptTokens: 1_000_010, CompletionTokens: 1_000_010, CostUSD: bobDeepSeekCost},
+			},
+		},
+		{
+			groupBy: []string{"model"},
+			want: []usageRow{
+				{Model: "claude-opus-4.6", Requests: 1, Errors: 1},
+				{Model: "claude-sonnet-4-6", Requests: 1, PromptTokens: 1_000_000, CacheReadTokens: 500_000, CompletionTokens: 100_000, CostUSD: claudeCost},
+				{Model: "deepseek-chat", Requests: 2, PromptTokens: 3_000_000, CompletionTokens: 1_000_000, CostUSD: bobDeepSeekCost + aliceDeepSeekCost},
+				{Model: "mystery-1", Requests: 1, PromptTokens: 10, CompletionTokens: 10},
+			},
+		},
+		{
+			groupBy: []string{"day", "user"},
+			want: []usageRow{
+				{Day: "2026-03-01", User: "alice", Requests: 1, PromptTokens: 1_000_000, CacheReadTokens: 500_000, CompletionTokens: 100_000, CostUSD: claudeCost},
+				{Day: "2026-03-01", User: "bob", Requests: 1, PromptTokens: 1_000_000, CompletionTokens: 1_000_000, CostUSD: bobDeepSeekCost},
+				{Day: "2026-03-02", User: "alice", Requests: 1, PromptTokens: 2_000_000, CostUSD: aliceDeepSeekCost},
+				{Day: "2026-03-02", User: "bob", Requests: 2, Errors: 1, PromptTokens: 10, CompletionTokens: 10},
+			},
+		},
+	}
+	for _, tc := range tests {
+		rows, total, unpriced := aggregateUsage(entries, tc.groupBy)
+		got := make([]usageRow, len(rows))
+		for i, r := range rows {
+			got[i] = *r
+			got[i].CostUSD = math.Round(r.CostUSD*1e9) / 1e9
+		}
+		for i := range tc.want {
+			tc.want[i].CostUSD = math.Round(tc.want[i].CostUSD*1e9) / 1e9
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("group by %v:\n got: %+v\nwant: %+v", tc.groupBy, got, tc.want)
+		}
+		if total.Requests != 5 || total.Errors != 1 || math.Abs(total.CostUSD-(claudeCost+bobDeepSeekCost+aliceDeepSeekCost)) > 1e-9 {
+			t.Errorf("group by %v: total = %+v", tc.groupBy, total)
+		}
+		if !reflect.DeepEqual(unpriced, []string{"mystery-1"}) {
+			t.Errorf("group by %v: unpriced = %v, want the served model without a price", tc.groupBy, unpriced)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// setupLogging installs the structured logger as the default, configured by
+// LOG_FORMAT (json or text) and LOG_LEVEL (debug, info, warn or error).
+// Everything logged goes through redactAttr.
+func setupLogging() error {
+	var level slog.Level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %q, available: debug, info, warn, error", v)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var handler slog.Handler
+	switch format := firstNonEmpty(os.Getenv("LOG_FORMAT"), "json"); format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q, available: json, text", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs an error and exits, for startup failures
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context carrying the request-scoped logger
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// logFor returns the request-scoped logger of ctx, or the default logger
+func logFor(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// logger returns the logger of the client request ur was translated from
+func (ur *UpstreamRequest) logger() *slog.Logger {
+	if ur.Log != nil {
+		return ur.Log
+	}
+	return slog.Default()
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID returns the client's X-Request-Id when it is a sane value, and a
+// new random ID otherwise
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); requestIDPattern.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("req-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// logRequest writes the summary line of a finished client request
+func logRequest(logger *slog.Logger, route, model string, call *upstreamCall, status int, duration time.Duration) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	attrs := []any{"route", route, "status", status, "duration_ms", duration.Milliseconds()}
+	if model != "" {
+		attrs = append(attrs, "model", model)
+	}
+	if call != nil {
+		ur := call.ur
+		attrs = append(attrs, "served_model", call.servedModel, "provider", call.provider.Name(), "stream", ur.Stream)
+		if !ur.SentAt.IsZero() {
+			attrs = append(attrs, "upstream_ms", time.Since(ur.SentAt).Milliseconds())
+		}
+		if !ur.FirstTokenAt.IsZero() {
+			attrs = append(attrs, "ttft_ms", ur.FirstTokenAt.Sub(ur.SentAt).Milliseconds())
+		}
+		if u := ur.Usage; u != nil {
+			attrs = append(attrs, "prompt_tokens", u.PromptTokens, "completion_tokens", u.CompletionTokens)
+		}
+		if ur.StreamErr != nil {
+			attrs = append(attrs, "stream_error", ur.StreamErr.Error())
+		}
+	}
+
+	msg, level := "Request completed", slog.LevelInfo
+	switch {
+	case status == statusClientClosed:
+		// Stopping a generation in Cursor is routine, not a failure
+		msg = "Request cancelled by client"
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+	logger.Log(context.Background(), level, msg, attrs...)
+}
+
+// maxLoggedBody caps the upstream bodies written to the log
+const maxLoggedBody = 2048
+
+// truncateForLog shortens a body for logging
+func truncateForLog(body []byte) string {
+	if len(body) <= maxLoggedBody {
+		return string(body)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", body[:maxLoggedBody], len(body))
+}
+
+// Secret redaction
+
+// secretAttrKeys are attribute keys whose values are never logged
+var secretAttrKeys = map[string]bool{
+	"authorization": true,
+	"x-api-key":     true,
+	"api_key":       true,
+	"apikey":        true,
+	"token":         true,
+	"secret":        true,
+}
+
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Authorization: Bearer <token>; short words are left alone so prose such
+	// as "bearer tokens" survives
+	{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]{8,}`), "${1}[REDACTED]"},
+	// x-api-key: <key>, also as JSON or in a header map dump
+	{regexp.MustCompile(`(?i)(x-api-key["']?\s*[:=]\s*\[?["']?)[^\s"',;\]]+`), "${1}[REDACTED]"},
+	// secret fields of JSON-encoded values, see secretAttrKeys
+	{regexp.MustCompile(`(?i)("(?:authorization|api_key|apikey|token|secret)"\s*:\s*\[?\s*")[^"]*`), "${1}[REDACTED]"},
+	// sk-... keys as used by Anthropic, DeepSeek and the proxy's own tokens
+	{regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{12,}`), "[REDACTED]"},
+}
+
+// knownSecrets are the configured keys and tokens, replaced by their masked
+// form wherever they appear
+var knownSecrets struct {
+	mu      sync.RWMutex
+	values  []string
+	replace *strings.Replacer
+}
+
+// registerSecret adds a configured key or token to the redaction list
+func registerSecret(secret string) {
+	if len(secret) < 8 {
+		return
+	}
+	knownSecrets.mu.Lock()
+	defer knownSecrets.mu.Unlock()
+	knownSecrets.values = append(knownSecrets.values, secret)
+	pairs := make([]string, 0, 2*len(knownSecrets.values))
+	for _, s := range knownSecrets.values {
+		pairs = append(pairs, s, maskKey(s))
+	}
+	knownSecrets.replace = strings.NewReplacer(pairs...)
+}
+
+// redact removes keys and tokens from s
+func redact(s string) string {
+	knownSecrets.mu.RLock()
+	replace := knownSecrets.replace
+	knownSecrets.mu.RUnlock()
+	if replace != nil {
+		s = replace.Replace(s)
+	}
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// redactAttr is the ReplaceAttr hook of the logger: secret attributes are
+// dropped and every string, including the message, is passed through redact.
+// Other values such as maps and structs are logged as their redacted JSON, or
+// their %+v form when they cannot be encoded.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if secretAttrKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redact(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			a.Value = slog.StringValue(redact(v.Error()))
+		case fmt.Stringer:
+			a.Value = slog.StringValue(redact(v.String()))
+		default:
+			if data, err := json.Marshal(v); err == nil {
+				a.Value = slog.StringValue(redact(string(data)))
+			} else {
+				a.Value = slog.StringValue(redact(fmt.Sprintf("%+v", v)))
+			}
+		}
+	}
+	return a
+}
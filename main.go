@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	envErr := godotenv.Load()
+	if err := setupLogging(); err != nil {
+		fatal("Invalid logging config", "error", err)
+	}
+	if envErr != nil {
+		slog.Warn(".env file not found or error loading it", "error", envErr)
+	}
+	registerSecret(os.Getenv("ADMIN_TOKEN"))
+	registerSecret(os.Getenv("METRICS_TOKEN"))
+
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
+	// Command-line flags override env vars
+	flagProvider := flag.String("provider", "", "Send every model to one provider: "+strings.Join(providerNames(), " | ")+" (overrides PROXY_PROVIDER)")
+	flagRoutes := flag.String("routes", "", "Model routing table, e.g. \""+defaultRoutes+"\" (overrides MODEL_ROUTES)")
+	flagEndpoint := flag.String("endpoint", "", "Upstream API endpoint for the -provider provider (overrides its endpoint env var)")
+	flagPort := flag.String("port", "", "Listen port (overrides PORT env var)")
+	flagKey := flag.String("key", "", "Comma-separated upstream API keys for the -provider provider (overrides its key env vars)")
+	flagModels := flag.String("models", "", "Model alias config file (overrides MODEL_CONFIG)")
+	flagClients := flag.String("clients", "", "Client token file for AUTH_MODE=tokens (overrides CLIENTS_CONFIG)")
+	flag.Parse()
+
+	var err error
+	if keyStrategy, err = keyPoolStrategy(); err != nil {
+		fatal("Invalid key pool", "error", err)
+	}
+
+	single := firstNonEmpty(*flagProvider, os.Getenv("PROXY_PROVIDER"))
+	if single == "" && (*flagEndpoint != "" || *flagKey != "") {
+		fatal("-endpoint and -key apply to a single provider, select it with -provider")
+	}
+	routeSpec := firstNonEmpty(*flagRoutes, os.Getenv("MODEL_ROUTES"))
+	if routeSpec == "" {
+		routeSpec = defaultRoutes
+		if single != "" {
+			routeSpec = "*=" + single
+		}
+	}
+
+	if single != "" {
+		p, err := buildProvider(single, *flagEndpoint, *flagKey)
+		if err != nil {
+			fatal("Invalid provider", "error", err)
+		}
+		providers[single] = p
+	}
+
+	routes, err = parseRoutes(routeSpec)
+	if err != nil {
+		fatal("Invalid model routes", "error", err)
+	}
+	for _, rt := range routes {
+		slog.Info("Model route", "pattern", rt.pattern, "provider", rt.provider.Name())
+	}
+
+	modelConfigPath := firstNonEmpty(*flagModels, os.Getenv("MODEL_CONFIG"))
+	if err := loadModelConfig(modelConfigPath); err != nil {
+		fatal("Invalid model config", "error", err)
+	}
+	if modelConfigPath != "" {
+		go watchModelConfig(modelConfigPath)
+	}
+
+	if err := setupAuth(firstNonEmpty(*flagClients, os.Getenv("CLIENTS_CONFIG"))); err != nil {
+		fatal("Invalid client authentication", "error", err)
+	}
+
+	if defaultLimits, err = defaultLimitsFromEnv(); err != nil {
+		fatal("Invalid client limits", "error", err)
+	}
+
+	if path := os.Getenv("USAGE_LEDGER"); path != "" {
+		if ledger, err = openUsageLedger(path); err != nil {
+			fatal("Invalid usage ledger", "error", err)
+		}
+	}
+
+	if captures, err = captureStoreFromEnv(); err != nil {
+		fatal("Invalid request capture", "error", err)
+	}
+
+	modelsCache = newModelListCache(modelsCacheTTL())
+	transport, err := transportConfigFromEnv()
+	if err != nil {
+		fatal("Invalid upstream transport settings", "error", err)
+	}
+	logTransportConfig(transport)
+	upstreamClient = newUpstreamClient(transport)
+	upstreamRetry = retryPolicyFromEnv()
+	heartbeatInterval = heartbeatIntervalFromEnv()
+	if promptCaching = promptCachingFromEnv(); promptCaching {
+		slog.Info("Anthropic prompt caching enabled")
+	}
+
+	port := firstNonEmpty(*flagPort, os.Getenv("PORT"), "9000")
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: http.HandlerFunc(proxyHandler),
+	}
+
+	slog.Info("Starting proxy server", "addr", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		fatal("Server failed", "error", err)
+	}
+}
+
+// buildProvider creates a registered provider from its env vars; non-empty
+// endpoint and apiKeys (comma-separated) arguments take precedence over them
+func buildProvider(name, endpoint, apiKeys string) (Provider, error) {
+	spec, ok := providerSpecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q, available: %s", name, strings.Join(providerNames(), ", "))
+	}
+	endpoint = strings.TrimRight(firstNonEmpty(endpoint, os.Getenv(spec.endpointEnv), spec.defaultEndpoint), "/")
+	keys := splitKeys(apiKeys)
+	if len(keys) == 0 {
+		keys = append(splitKeys(os.Getenv(spec.keyEnv)), splitKeys(os.Getenv(spec.keyEnv+"S"))...)
+	}
+	pool := newKeyPool(name, keyStrategy, keys)
+	if pool.size() == 0 {
+		slog.Warn("No server API key set, users must provide their own", "provider", name, "env", spec.keyEnv)
+	}
+	slog.Info("Initialized provider", "provider", name, "endpoint", endpoint, "server_keys", pool.size())
+	return spec.newProvider(endpoint, pool), nil
+}
+
+func enableCors(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, anthropic-version, x-api-key, X-Request-Id")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, X-Request-Id")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+}
+
+// statusWriter remembers the status code sent to the client
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+
+	// Every log line of the request carries its ID, which is echoed back
+	reqID := requestID(r)
+	w.Header().Set("X-Request-Id", reqID)
+	logger := slog.Default().With("request_id", reqID)
+	r = r.WithContext(withLogger(r.Context(), logger))
+	logger.Debug("Received request", "method", r.Method, "path", r.URL.Path)
+
+	enableCors(w)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	if r.URL.Path == "/metrics" {
+		handleMetricsRequest(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		handleAdminRequest(w, r)
+		return
+	}
+
+	route := metricsRoute(r.URL.Path)
+	var requestModel string
+	var call *upstreamCall
+	// status is the outcome the request is recorded with; a stream the
+	// upstream broke off counts as a bad gateway although it started with 200
+	status := func() int {
+		if r.Context().Err() != nil {
+			return statusClientClosed
+		}
+		if call != nil && call.ur.StreamErr != nil {
+			return http.StatusBadGateway
+		}
+		return sw.status
+	}
+	defer func() {
+		observeRequest(route, call, status())
+		logRequest(logger, route, requestModel, call, status(), time.Since(start))
+	}()
+
+	client := authenticateClient(w, r)
+	if client == nil {
+		return
+	}
+
+	if (r.URL.Path == "/v1/models" || r.URL.Path == "/models") && r.Method == "GET" {
+		handleModelsRequest(w)
+		return
+	}
+
+	// Normalize path - support both /v1/chat/completions and /chat/completions
+	requestPath := r.URL.Path
+	if !strings.HasPrefix(requestPath, "/v1/") {
+		requestPath = "/v1" + requestPath
+	}
+	if requestPath != "/v1/chat/completions" {
+		logger.Info("Invalid path", "path", r.URL.Path, "normalized", requestPath)
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "", fmt.Sprintf("Invalid URL (%s %s)", r.Method, r.URL.Path))
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "Error reading the request body")
+		return
+	}
+	defer r.Body.Close()
+
+	capt := captures.start(reqID, body)
+	w = capt.wrap(w)
+	defer func() {
+		capt.save(status())
+	}()
+
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal(body, &reqMap); err != nil {
+		logger.Info("Error parsing request JSON", "error", err)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", "We could not parse the JSON body of your request: "+err.Error())
+		return
+	}
+	// Checked only now so that malformed requests do not use up the client's limit
+	if !checkRateLimit(w, r, client) {
+		return
+	}
+	requestModel, _ = reqMap["model"].(string)
+	logger.Info("Chat completion request", "user", client.User, "model", requestModel)
+
+	defer func() {
+		recordRequest(reqID, client, requestModel, call, status(), time.Since(start))
+	}()
+
+	call, err = forwardWithFallback(r, body, reqMap, requestModel, client)
+	if err != nil {
+		if pe, ok := err.(*proxyError); ok {
+			writeOpenAIError(w, pe.status, pe.errType, pe.code, pe.message)
+			return
+		}
+		if r.Context().Err() != nil {
+			logger.Info("Client disconnected before the upstream answered", "model", requestModel)
+			return
+		}
+		logger.Error("Error forwarding request", "model", requestModel, "error", err)
+		if classifyTransportError(err) == triggerTimeout {
+			writeOpenAIError(w, http.StatusGatewayTimeout, "server_error", "timeout", "The upstream did not answer in time")
+		} else {
+			writeOpenAIError(w, http.StatusBadGateway, "server_error", "upstream_unreachable", "Error forwarding the request to the upstream")
+		}
+		return
+	}
+	capt.recordUpstream(call)
+	resp, ur, p := call.resp, call.ur, call.provider
+	defer resp.Body.Close()
+
+	if call.model != requestModel {
+		logger.Info("Served fallback model", "model", requestModel, "fallback_model", call.model, "served_model", call.servedModel, "provider", p.Name())
+	}
+	w.Header().Set("X-Served-Model", call.servedModel)
+
+	// Upstream error responses are answered in OpenAI format
+	if resp.StatusCode >= 400 {
+		writeUpstreamError(w, resp, call.errBody)
+		return
+	}
+
+	if ur.Stream {
+		streamsInFlight.add(1, p.Name())
+		p.TranslateStream(w, resp, ur)
+		streamsInFlight.add(-1, p.Name())
+	} else {
+		p.TranslateResponse(w, resp, ur)
+	}
+	if ur.Usage != nil {
+		limiter.addTokens(client, ur.Usage.TotalTokens, time.Now())
+	}
+}
+
+// proxyError is a failure detected by the proxy itself, answered with status
+// and an OpenAI error of errType and code
+type proxyError struct {
+	status  int
+	errType string
+	code    string
+	message string
+}
+
+func (e *proxyError) Error() string { return e.message }
+
+// upstreamCall is the outcome of sending a client request as one model
+type upstreamCall struct {
+	// model is the client-facing name the request was sent as
+	model string
+	// servedModel is the upstream model ID after alias resolution
+	servedModel string
+	provider    Provider
+	ur          *UpstreamRequest
+	resp        *http.Response
+	// errBody holds the body of an error response, which has been read
+	errBody []byte
+}
+
+// forwardModel routes, translates and sends the client request as model. Setup
+// failures are returned as *proxyError and upstream round-trip failures as
+// plain errors. Error responses are read into errBody, decoded, so they can be
+// inspected and answered in OpenAI format.
+func forwardModel(r *http.Request, body []byte, reqMap map[string]interface{}, model string, client *proxyClient) (*upstreamCall, error) {
+	logger := logFor(r.Context())
+	// Route on the model, resolving aliases first
+	p := providerForModel(model)
+	if p == nil {
+		logger.Info("No route for model", "model", model)
+		return nil, &proxyError{http.StatusNotFound, "invalid_request_error", "model_not_found", fmt.Sprintf("No upstream configured for model %q", model)}
+	}
+	body, servedModel, aliased, err := requestBodyFor(body, reqMap, model)
+	if err != nil {
+		return nil, &proxyError{http.StatusInternalServerError, "server_error", "", "Error serializing request"}
+	}
+	logger = logger.With("model", model, "provider", p.Name())
+	if aliased {
+		logger = logger.With("served_model", servedModel)
+	}
+	logger.Debug("Routing model")
+
+	// Prefer the client's bound key, otherwise use the provider's server key pool
+	clientKey := client.upstreamKey(p.Name())
+	if clientKey == "" && p.Keys().size() == 0 {
+		logger.Error("No server API key configured")
+		return nil, &proxyError{http.StatusInternalServerError, "server_error", "upstream_not_configured", fmt.Sprintf("No upstream API key configured for %s", p.Name())}
+	}
+
+	ur, err := p.TranslateRequest(body)
+	if err != nil {
+		logger.Info("Error converting request", "error", err)
+		return nil, &proxyError{http.StatusBadRequest, "invalid_request_error", "", err.Error()}
+	}
+	if aliased {
+		// Report the alias the client asked for, not the upstream model
+		ur.Model = model
+	}
+	ur.Log = logger
+
+	resp, err := sendWithRetry(r, p, ur, clientKey)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("Upstream response", "status", resp.StatusCode, "upstream_ms", time.Since(ur.SentAt).Milliseconds())
+
+	call := &upstreamCall{model: model, servedModel: servedModel, provider: p, ur: ur, resp: resp}
+	if resp.StatusCode >= 400 {
+		call.errBody, err = readResponse(resp)
+		resp.Body.Close()
+		if err != nil {
+			logger.Error("Error reading upstream error response", "error", err)
+			return nil, &proxyError{http.StatusBadGateway, "server_error", "", "Error reading the upstream error response"}
+		}
+		// errBody is decoded
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.Body = io.NopCloser(bytes.NewReader(call.errBody))
+		logger.Warn("Upstream error response", "status", resp.StatusCode, "body", truncateForLog(call.errBody))
+	}
+	return call, nil
+}
+
+// requestBodyFor returns the client request body to translate when sending it
+// as model, with the model's alias applied, and the upstream model ID it is
+// served as
+func requestBodyFor(body []byte, reqMap map[string]interface{}, model string) ([]byte, string, bool, error) {
+	alias, aliased := lookupAlias(model)
+	if !aliased && model == reqMap["model"] {
+		return body, model, false, nil
+	}
+	req := make(map[string]interface{}, len(reqMap))
+	for k, v := range reqMap {
+		req[k] = v
+	}
+	req["model"] = model
+	servedModel := model
+	if aliased {
+		applyAlias(req, alias)
+		servedModel = alias.Model
+	}
+	body, err := json.Marshal(req)
+	return body, servedModel, aliased, err
+}
+
+// handleModelsRequest serves the union of the model lists of every routed
+// provider, queried from the upstreams and cached, followed by the aliases and
+// extra models from the model config
+func handleModelsRequest(w http.ResponseWriter) {
+	// Query the providers in parallel; the merge keeps the routing order
+	routed := routedProviders()
+	lists := make([][]Model, len(routed))
+	var wg sync.WaitGroup
+	for i, p := range routed {
+		wg.Add(1)
+		go func(i int, p Provider) {
+			defer wg.Done()
+			lists[i] = modelsCache.get(p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	response := ModelsResponse{Object: "list", Data: []Model{}}
+	seen := map[string]bool{}
+	for _, list := range lists {
+		for _, m := range list {
+			if seen[m.ID] || routeModel(m.ID) == nil {
+				continue
+			}
+			seen[m.ID] = true
+			response.Data = append(response.Data, m)
+		}
+	}
+	for _, m := range configuredModels() {
+		if !seen[m.ID] {
+			seen[m.ID] = true
+			response.Data = append(response.Data, m)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// statusClientClosed is the status requests are recorded with when the client
+// disconnected before the response was complete, as in nginx
+const statusClientClosed = 499
+
+// clientGone reports whether an upstream response failed because the client
+// went away: upstream requests carry the client request's context, which is
+// cancelled when the client disconnects. UPSTREAM_TIMEOUT expiring is a
+// deadline, not a cancellation.
+func clientGone(resp *http.Response) bool {
+	return resp.Request != nil && errors.Is(resp.Request.Context().Err(), context.Canceled)
+}
+
+// readResponse reads an upstream response body, handling compression
+func readResponse(resp *http.Response) ([]byte, error) {
+	var reader io.Reader = resp.Body
+
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		gzReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error creating gzip reader: %v", err)
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	case "br":
+		reader = brotli.NewReader(resp.Body)
+	case "deflate":
+		reader = flate.NewReader(resp.Body)
+	}
+
+	return io.ReadAll(reader)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
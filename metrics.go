@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is a counter, gauge or histogram with labels, written in the
+// Prometheus text format
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	// buckets are the histogram upper bounds, ascending
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	// value is the counter or gauge value
+	value float64
+	// counts, sum and count are the histogram state; counts are per bucket,
+	// made cumulative when written
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricsRegistry holds every metric in the order it is written on /metrics
+var metricsRegistry []*metric
+
+func newMetric(kind, name, help string, buckets []float64, labels ...string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: map[string]*series{}}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric("counter", name, help, nil, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return newMetric("gauge", name, help, nil, labels...)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return newMetric("histogram", name, help, buckets, labels...)
+}
+
+// get returns the series for labelValues; m.mu must be held
+func (m *metric) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add increments a counter or moves a gauge by v
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+// observe records v in a histogram
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+// formatLabels renders {name="value",...}, with an extra label when extraName is set
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Latency buckets in seconds; streamed completions can run for minutes
+var (
+	latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	ttftBuckets    = []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 30, 60}
+)
+
+var (
+	requestsTotal = newCounter("cursor_proxy_requests_total",
+		"Client requests by route, served model, provider and response status; the model is \"unknown\" when no upstream was called.",
+		"route", "model", "provider", "status")
+	upstreamResponsesTotal = newCounter("cursor_proxy_upstream_responses_total",
+		"Upstream attempts by provider and status, \"error\" when no response was received.",
+		"provider", "status")
+	upstreamDuration = newHistogram("cursor_proxy_upstream_duration_seconds",
+		"Time from sending the request upstream to the end of the response.",
+		latencyBuckets, "provider", "model", "stream")
+	upstreamTTFT = newHistogram("cursor_proxy_upstream_time_to_first_token_seconds",
+		"Time from sending a streaming request upstream to its first content chunk.",
+		ttftBuckets, "provider", "model")
+	tokensTotal = newCounter("cursor_proxy_tokens_total",
+		"Tokens reported by the upstreams, by type: prompt, completion, cache_read or cache_write.",
+		"provider", "model", "type")
+	retriesTotal = newCounter("cursor_proxy_upstream_retries_total",
+		"Upstream requests retried, by provider and the status that caused the retry.",
+		"provider", "status")
+	fallbacksTotal = newCounter("cursor_proxy_fallbacks_total",
+		"Requests moved on to a fallback model, by trigger.",
+		"from", "to", "trigger")
+	streamsInFlight = newGauge("cursor_proxy_streams_in_flight",
+		"Streaming responses currently being relayed.",
+		"provider")
+)
+
+// metricsRoute is the route label of a request path
+func metricsRoute(path string) string {
+	switch strings.TrimPrefix(path, "/v1") {
+	case "/chat/completions":
+		return "/v1/chat/completions"
+	case "/models":
+		return "/v1/models"
+	}
+	return "other"
+}
+
+// statusLabel is the status label of an upstream attempt: the HTTP status,
+// "cancelled" when the client went away first and "error" for other failures
+func statusLabel(resp *http.Response, err error) string {
+	if errors.Is(err, context.Canceled) {
+		return "cancelled"
+	}
+	if err != nil || resp == nil {
+		return "error"
+	}
+	return strconv.Itoa(resp.StatusCode)
+}
+
+// observeRequest records a finished client request. call is nil when the
+// request never reached an upstream. The model label is the served model
+// rather than the one the client sent, so clients cannot create series at will.
+func observeRequest(route string, call *upstreamCall, status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	model, provider := "unknown", ""
+	if call != nil {
+		model, provider = call.servedModel, call.provider.Name()
+	}
+	requestsTotal.add(1, route, model, provider, strconv.Itoa(status))
+	if call == nil {
+		return
+	}
+
+	ur := call.ur
+	if !ur.SentAt.IsZero() {
+		upstreamDuration.observe(time.Since(ur.SentAt).Seconds(), provider, call.servedModel, strconv.FormatBool(ur.Stream))
+		if !ur.FirstTokenAt.IsZero() {
+			upstreamTTFT.observe(ur.FirstTokenAt.Sub(ur.SentAt).Seconds(), provider, call.servedModel)
+		}
+	}
+	if u := ur.Usage; u != nil {
+		tokensTotal.add(float64(u.PromptTokens), provider, call.servedModel, "prompt")
+		tokensTotal.add(float64(u.CompletionTokens), provider, call.servedModel, "completion")
+		tokensTotal.add(float64(u.cachedTokens()), provider, call.servedModel, "cache_read")
+		tokensTotal.add(float64(u.CacheWriteTokens), provider, call.servedModel, "cache_write")
+	}
+}
+
+// handleMetricsRequest serves /metrics in the Prometheus text format. When
+// METRICS_TOKEN is set it is required as the Bearer token.
+func handleMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	if token := os.Getenv("METRICS_TOKEN"); token != "" {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Invalid metrics token")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics returns the /metrics output as a map from series to value
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleMetricsRequest(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics status = %d; body: %s", rec.Code, rec.Body)
+	}
+	values := map[string]float64{}
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid metrics line %q", line)
+		}
+		values[line[:i]] = v
+	}
+	return values
+}
+
+func TestMetricsOutput(t *testing.T) {
+	upstream := newMockUpstream(t, anthropicResponse("Hello!"))
+	useRoutes(t, route{pattern: "claude-*", provider: testProvider(t, "o2a", upstream.URL)})
+	useModelConfig(t, &modelConfig{Aliases: map[string]modelAlias{
+		"claude-metrics-alias": {Model: "claude-metrics-served"},
+	}})
+	before := scrapeMetrics(t)
+
+	if rec := postChat(t, chatRequest("claude-metrics-alias", false)); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+	}
+	if rec := postChat(t, chatRequest("client-chosen-model-1234", false)); rec.Code != http.StatusNotFound {
+		t.Fatalf("unrouted model status = %d; body: %s", rec.Code, rec.Body)
+	}
+	after := scrapeMetrics(t)
+
+	tests := []struct {
+		series string
+		want   float64
+	}{
+		{`cursor_proxy_requests_total{route="/v1/chat/completions",model="claude-metrics-served",provider="o2a",status="200"}`, 1},
+		{`cursor_proxy_requests_total{route="/v1/chat/completions",model="unknown",provider="",status="404"}`, 1},
+		{`cursor_proxy_upstream_responses_total{provider="o2a",status="200"}`, 1},
+		{`cursor_proxy_upstream_duration_seconds_bucket{provider="o2a",model="claude-metrics-served",stream="false",le="+Inf"}`, 1},
+		{`cursor_proxy_upstream_duration_seconds_count{provider="o2a",model="claude-metrics-served",stream="false"}`, 1},
+		{`cursor_proxy_tokens_total{provider="o2a",model="claude-metrics-served",type="prompt"}`, 9},
+	}
+	for _, tc := range tests {
+		if got := after[tc.series] - before[tc.series]; got != tc.want {
+			t.Errorf("%s went up by %v, want %v", tc.series, got, tc.want)
+		}
+	}
+	for series := range after {
+		if strings.Contains(series, "claude-metrics-alias") || strings.Contains(series, "client-chosen-model-1234") {
+			t.Errorf("series %s is labelled with the model the client sent", series)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Keep test output readable; set LOG_LEVEL to see the proxy logs
+	if os.Getenv("LOG_LEVEL") == "" {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	} else if err := setupLogging(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// upstreamReply is one scripted answer of a mock upstream
+type upstreamReply struct {
+	status int
+	// body is sent as application/json unless events is set
+	body string
+	// events are sent as an SSE stream, each followed by a blank line
+	events []string
+	// truncate aborts the connection after the events instead of ending the
+	// response cleanly, like an upstream dying mid-stream
+	truncate bool
+	// hold keeps the stream open after the events until the proxy closes the
+	// connection, like a model that is still thinking
+	hold   bool
+	header map[string]string
+}
+
+// upstreamRequest is a request received by a mock upstream
+type upstreamRequest struct {
+	path   string
+	header http.Header
+	body   map[string]interface{}
+}
+
+// mockUpstream is an in-process DeepSeek, POE or Anthropic server answering
+// with scripted replies, in order
+type mockUpstream struct {
+	*httptest.Server
+	t *testing.T
+
+	mu       sync.Mutex
+	replies  []upstreamReply
+	requests []upstreamRequest
+
+	// holding is closed when a hold reply has sent its events, released when
+	// the proxy has closed that connection; stop ends the hold at cleanup so
+	// a failing test does not block in Close
+	holding, released, stop chan struct{}
+}
+
+func newMockUpstream(t *testing.T, replies ...upstreamReply) *mockUpstream {
+	t.Helper()
+	m := &mockUpstream{t: t, replies: replies, holding: make(chan struct{}), released: make(chan struct{}), stop: make(chan struct{})}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.Close)
+	t.Cleanup(func() { close(m.stop) })
+	return m
+}
+
+func (m *mockUpstream) serve(w http.ResponseWriter, r *http.Request) {
+	req := upstreamRequest{path: r.URL.Path, header: r.Header.Clone()}
+	if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+		if err := json.Unmarshal(data, &req.body); err != nil {
+			m.t.Errorf("mock upstream: invalid request body %q: %v", data, err)
+		}
+	}
+
+	m.mu.Lock()
+	m.requests = append(m.requests, req)
+	if len(m.replies) == 0 {
+		m.mu.Unlock()
+		m.t.Errorf("mock upstream: unexpected request to %s", r.URL.Path)
+		http.Error(w, "no scripted reply", http.StatusInternalServerError)
+		return
+	}
+	reply := m.replies[0]
+	m.replies = m.replies[1:]
+	m.mu.Unlock()
+
+	for k, v := range reply.header {
+		w.Header().Set(k, v)
+	}
+	status := reply.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if reply.events == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, reply.body)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(status)
+	for _, event := range reply.events {
+		io.WriteString(w, event+"\n\n")
+		w.(http.Flusher).Flush()
+	}
+	if reply.truncate {
+		panic(http.ErrAbortHandler)
+	}
+	if reply.hold {
+		close(m.holding)
+		select {
+		case <-r.Context().Done():
+			close(m.released)
+		case <-m.stop:
+		}
+	}
+}
+
+// received returns the requests the upstream got so far
+func (m *mockUpstream) received() []upstreamRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]upstreamRequest(nil), m.requests...)
+}
+
+// dataEvent is an OpenAI-style SSE event
+func dataEvent(data string) string {
+	return "data: " + data
+}
+
+// anthropicEvent is a named Anthropic SSE event
+func anthropicEvent(eventType, data string) string {
+	return "event: " + eventType + "\ndata: " + data
+}
+
+// useProvider routes every model to a fresh instance of the named provider
+// pointing at upstream, with authentication and retries off, for the rest of
+// the test
+func useProvider(t *testing.T, name, upstream string) {
+	t.Helper()
+	useRoutes(t, route{pattern: "*", provider: testProvider(t, name, upstream)})
+}
+
+// testProvider builds a fresh instance of the named provider pointing at
+// upstream, with one server key
+func testProvider(t *testing.T, name, upstream string) Provider {
+	t.Helper()
+	spec, ok := providerSpecs[name]
+	if !ok {
+		t.Fatalf("unknown provider %q", name)
+	}
+	return spec.newProvider(upstream, newKeyPool(name, keyStrategyRoundRobin, []string{"sk-test-upstream-key"}))
+}
+
+// useRoutes installs a routing table with authentication and retries off for
+// the rest of the test
+func useRoutes(t *testing.T, rules ...route) {
+	t.Helper()
+	oldRoutes, oldAuth, oldRetry := routes, authMode, upstreamRetry
+	t.Cleanup(func() { routes, authMode, upstreamRetry = oldRoutes, oldAuth, oldRetry })
+	routes = rules
+	authMode = authModeNone
+	upstreamRetry = retryPolicy{maxRetries: 0, baseDelay: 0}
+}
+
+// useUpstreamClient sends upstream requests with a client built from cfg for
+// the rest of the test
+func useUpstreamClient(t *testing.T, cfg transportConfig) {
+	t.Helper()
+	old := upstreamClient
+	t.Cleanup(func() { upstreamClient = old })
+	upstreamClient = newUpstreamClient(cfg)
+}
+
+// postChat sends a chat completion request through proxyHandler
+func postChat(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	proxyHandler(rec, req)
+	return rec
+}
+
+var createdTimestamp = regexp.MustCompile(`"created":\d+`)
+
+// sseData returns the data payloads of an SSE response in order, with the
+// creation timestamps, which the Anthropic translator takes from the clock,
+// zeroed
+func sseData(body string) []string {
+	var out []string
+	for _, line := range strings.Split(body, "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			out = append(out, createdTimestamp.ReplaceAllString(data, `"created":0`))
+		}
+	}
+	return out
+}
+
+// canonicalJSON re-encodes a JSON document with sorted keys and zeroed
+// creation timestamps so it can be compared as a string
+func canonicalJSON(t *testing.T, data string) string {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatalf("invalid JSON %q: %v", data, err)
+	}
+	out, _ := json.Marshal(v)
+	return createdTimestamp.ReplaceAllString(string(out), `"created":0`)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// modelConfigPollInterval is how often the model config file is checked for changes
+const modelConfigPollInterval = 5 * time.Second
+
+// modelAlias maps a client-facing model name to an upstream model. The optional
+// fields are defaults applied when the client request does not set them.
+type modelAlias struct {
+	Model string `yaml:"model"`
+	// Provider pins the alias to a provider instead of routing on the alias name
+	Provider       string   `yaml:"provider"`
+	MaxTokens      *int     `yaml:"max_tokens"`
+	Temperature    *float64 `yaml:"temperature"`
+	ThinkingBudget int      `yaml:"thinking_budget"`
+}
+
+// modelConfig is the content of the MODEL_CONFIG file (or MODEL_ALIASES env
+// var), written in YAML or JSON
+type modelConfig struct {
+	Aliases map[string]modelAlias `yaml:"aliases"`
+	// Models lists extra model IDs served on /v1/models besides the aliases
+	// and the upstream model lists
+	Models []string `yaml:"models"`
+	// Fallbacks is checked in order; the first rule matching a model applies.
+	// A config without the key keeps defaultFallbacks.
+	Fallbacks []fallbackRule `yaml:"fallbacks"`
+	// Prices is checked in order; the first entry matching a served model
+	// prices it in the /admin/usage cost estimates
+	Prices []modelPrice `yaml:"prices"`
+
+	loadedAt time.Time
+}
+
+// defaultModelConfig has no aliases; model names go to the routed provider as
+// sent, renamed only by the provider's built-in model map
+var defaultModelConfig = &modelConfig{Fallbacks: defaultFallbacks, loadedAt: time.Now()}
+
+var (
+	modelConfigMu     sync.RWMutex
+	activeModelConfig = defaultModelConfig
+)
+
+func currentModelConfig() *modelConfig {
+	modelConfigMu.RLock()
+	defer modelConfigMu.RUnlock()
+	return activeModelConfig
+}
+
+// modelConfigLoaded reports whether a model config file or MODEL_ALIASES
+// value is active. Without one the providers' built-in model maps apply.
+func modelConfigLoaded() bool {
+	return currentModelConfig() != defaultModelConfig
+}
+
+// lookupAlias returns the alias configured for a client model name
+func lookupAlias(model string) (modelAlias, bool) {
+	alias, ok := currentModelConfig().Aliases[model]
+	return alias, ok && alias.Model != ""
+}
+
+func parseModelConfig(data []byte) (*modelConfig, error) {
+	cfg := &modelConfig{}
+	// JSON is valid YAML, so one decoder handles both formats
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	for name, alias := range cfg.Aliases {
+		if alias.Model == "" {
+			return nil, fmt.Errorf("alias %q has no model", name)
+		}
+		if alias.Provider != "" {
+			if _, err := getProvider(alias.Provider); err != nil {
+				return nil, fmt.Errorf("alias %q: %v", name, err)
+			}
+		}
+	}
+	if cfg.Fallbacks == nil {
+		cfg.Fallbacks = defaultFallbacks
+	}
+	for _, f := range cfg.Fallbacks {
+		if err := f.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, price := range cfg.Prices {
+		if price.Model == "" {
+			return nil, fmt.Errorf("price entry needs a model pattern")
+		}
+	}
+	cfg.loadedAt = time.Now()
+	return cfg, nil
+}
+
+// loadModelConfig reads the model config file, or the inline MODEL_ALIASES
+// value when no file is given, and makes it active
+func loadModelConfig(path string) error {
+	var data []byte
+	var err error
+	switch {
+	case path != "":
+		if data, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	case os.Getenv("MODEL_ALIASES") != "":
+		data = []byte(os.Getenv("MODEL_ALIASES"))
+	default:
+		slog.Info("No model config set, using built-in model names")
+		return nil
+	}
+
+	cfg, err := parseModelConfig(data)
+	if err != nil {
+		return err
+	}
+	modelConfigMu.Lock()
+	activeModelConfig = cfg
+	modelConfigMu.Unlock()
+	slog.Info("Loaded model config", "aliases", len(cfg.Aliases), "fallbacks", len(cfg.Fallbacks), "prices", len(cfg.Prices))
+	return nil
+}
+
+// watchModelConfig reloads the model config file on SIGHUP and whenever its
+// modification time changes. A config that fails to load leaves the previous
+// one in place.
+func watchModelConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+	ticker := time.NewTicker(modelConfigPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			slog.Info("SIGHUP received, reloading model config", "path", path)
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			slog.Info("Model config changed, reloading", "path", path)
+		}
+		if err := loadModelConfig(path); err != nil {
+			slog.Error("Error reloading model config, keeping previous", "path", path, "error", err)
+		}
+	}
+}
+
+// applyAlias rewrites the client request for an alias: the upstream model name
+// is substituted and the alias defaults fill in fields the client left unset
+func applyAlias(reqMap map[string]interface{}, alias modelAlias) {
+	reqMap["model"] = alias.Model
+	if _, ok := reqMap["max_tokens"]; !ok && alias.MaxTokens != nil {
+		if _, ok := reqMap["max_completion_tokens"]; !ok {
+			reqMap["max_tokens"] = *alias.MaxTokens
+		}
+	}
+	if _, ok := reqMap["temperature"]; !ok && alias.Temperature != nil {
+		reqMap["temperature"] = *alias.Temperature
+	}
+	_, hasThinking := reqMap["thinking"]
+	_, hasEffort := reqMap["reasoning_effort"]
+	if alias.ThinkingBudget > 0 && !hasThinking && !hasEffort {
+		reqMap["thinking"] = map[string]interface{}{"type": "enabled", "budget_tokens": alias.ThinkingBudget}
+	}
+}
+
+// configuredModels returns the extra models and aliases from the model config
+// that are listed on /v1/models
+func configuredModels() []Model {
+	cfg := currentModelConfig()
+	created := cfg.loadedAt.Unix()
+	var out []Model
+	seen := map[string]bool{}
+	add := func(id string, p Provider) {
+		if seen[id] || p == nil {
+			return
+		}
+		seen[id] = true
+		out = append(out, Model{ID: id, Object: "model", Created: created, OwnedBy: p.Name()})
+	}
+	for _, id := range cfg.Models {
+		add(id, routeModel(id))
+	}
+	names := make([]string, 0, len(cfg.Aliases))
+	for name := range cfg.Aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(name, providerForModel(name))
+	}
+	return out
+}
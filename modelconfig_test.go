@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useModelConfig makes cfg the active model config for the rest of the test
+func useModelConfig(t *testing.T, cfg *modelConfig) {
+	t.Helper()
+	modelConfigMu.Lock()
+	old := activeModelConfig
+	activeModelConfig = cfg
+	modelConfigMu.Unlock()
+	t.Cleanup(func() {
+		modelConfigMu.Lock()
+		activeModelConfig = old
+		modelConfigMu.Unlock()
+	})
+}
+
+func intPtr(v int) *int           { return &v }
+func floatPtr(v float64) *float64 { return &v }
+
+func TestParseModelConfig(t *testing.T) {
+	want := map[string]modelAlias{
+		"claude-opus-4.6": {Model: "claude-sonnet-4-6", MaxTokens: intPtr(16000), Temperature: floatPtr(0.5), ThinkingBudget: 8192},
+		"fast":            {Model: "deepseek-chat", Provider: "deepseek"},
+	}
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name: "yaml",
+			data: `
+aliases:
+  claude-opus-4.6:
+    model: claude-sonnet-4-6
+    max_tokens: 16000
+    temperature: 0.5
+    thinking_budget: 8192
+  fast:
+    model: deepseek-chat
+    provider: deepseek
+models:
+  - deepseek-reasoner
+`,
+		},
+		{
+			name: "json",
+			data: `{"aliases":{` +
+				`"claude-opus-4.6":{"model":"claude-sonnet-4-6","max_tokens":16000,"temperature":0.5,"thinking_budget":8192},` +
+				`"fast":{"model":"deepseek-chat","provider":"deepseek"}},` +
+				`"models":["deepseek-reasoner"]}`,
+		},
+		{name: "alias without model", data: `{"aliases":{"fast":{"provider":"deepseek"}}}`, wantErr: `alias "fast" has no model`},
+		{name: "unknown provider", data: `{"aliases":{"fast":{"model":"x","provider":"nope"}}}`, wantErr: `unknown provider "nope"`},
+		{name: "price without model", data: `{"prices":[{"input":1}]}`, wantErr: "price entry needs a model pattern"},
+		{name: "invalid syntax", data: `{"aliases":`, wantErr: "yaml"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := parseModelConfig([]byte(tc.data))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseModelConfig: %v", err)
+			}
+			if !reflect.DeepEqual(cfg.Aliases, want) {
+				t.Errorf("aliases = %+v, want %+v", cfg.Aliases, want)
+			}
+			if !reflect.DeepEqual(cfg.Models, []string{"deepseek-reasoner"}) {
+				t.Errorf("models = %v", cfg.Models)
+			}
+			if !reflect.DeepEqual(cfg.Fallbacks, defaultFallbacks) {
+				t.Errorf("fallbacks = %+v, want the defaults", cfg.Fallbacks)
+			}
+		})
+	}
+}
+
+func TestApplyAlias(t *testing.T) {
+	alias := modelAlias{Model: "claude-sonnet-4-6", MaxTokens: intPtr(16000), Temperature: floatPtr(0.5), ThinkingBudget: 8192}
+	thinking := map[string]interface{}{"type": "enabled", "budget_tokens": 8192}
+	tests := []struct {
+		name    string
+		request string
+		alias   modelAlias
+		want    map[string]interface{}
+	}{
+		{
+			name:    "defaults fill unset fields",
+			request: `{"model":"opus"}`,
+			alias:   alias,
+			want:    map[string]interface{}{"model": "claude-sonnet-4-6", "max_tokens": 16000, "temperature": 0.5, "thinking": thinking},
+		},
+		{
+			name:    "client values win",
+			request: `{"model":"opus","max_tokens":100,"temperature":1,"thinking":{"type":"disabled"}}`,
+			alias:   alias,
+			want:    map[string]interface{}{"model": "claude-sonnet-4-6", "max_tokens": float64(100), "temperature": float64(1), "thinking": map[string]interface{}{"type": "disabled"}},
+		},
+		{
+			name:    "max_completion_tokens counts as set",
+			request: `{"model":"opus","max_completion_tokens":100,"reasoning_effort":"low"}`,
+			alias:   alias,
+			want:    map[string]interface{}{"model": "claude-sonnet-4-6", "max_completion_tokens": float64(100), "temperature": 0.5, "reasoning_effort": "low"},
+		},
+		{
+			name:    "model only",
+			request: `{"model":"fast","temperature":0}`,
+			alias:   modelAlias{Model: "deepseek-chat"},
+			want:    map[string]interface{}{"model": "deepseek-chat", "temperature": float64(0)},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var reqMap map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.request), &reqMap); err != nil {
+				t.Fatal(err)
+			}
+			applyAlias(reqMap, tc.alias)
+			if !reflect.DeepEqual(reqMap, tc.want) {
+				t.Errorf("request = %v, want %v", reqMap, tc.want)
+			}
+		})
+	}
+}
+
+func TestProviderForModel(t *testing.T) {
+	deepseek, err := getProvider("deepseek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	poe, err := getProvider("poe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRoutes := routes
+	t.Cleanup(func() { routes = oldRoutes })
+	routes = []route{{pattern: "*", provider: poe}}
+	useModelConfig(t, &modelConfig{Aliases: map[string]modelAlias{
+		"pinned":   {Model: "deepseek-chat", Provider: "deepseek"},
+		"unpinned": {Model: "deepseek-chat"},
+	}})
+
+	tests := []struct {
+		model string
+		want  Provider
+	}{
+		{"pinned", deepseek},
+		{"unpinned", poe},
+		{"deepseek-chat", poe},
+	}
+	for _, tc := range tests {
+		if got := providerForModel(tc.model); got != tc.want {
+			t.Errorf("providerForModel(%q) = %v, want %s", tc.model, got, tc.want.Name())
+		}
+	}
+}
+
+func TestBuiltinModelMap(t *testing.T) {
+	p := &anthropicProvider{name: "o2a", modelMap: modelNameMap}
+	upstreamModel := func() string {
+		ur, err := p.TranslateRequest([]byte(chatRequest("claude-opus-4.6", false)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]interface{}
+		json.Unmarshal(ur.Body, &body)
+		return body["model"].(string)
+	}
+
+	useModelConfig(t, defaultModelConfig)
+	if got := upstreamModel(); got != "claude-sonnet-4-6" {
+		t.Errorf("without a model config: upstream model = %s, want the built-in mapping", got)
+	}
+	useModelConfig(t, &modelConfig{})
+	if got := upstreamModel(); got != "claude-opus-4-6" {
+		t.Errorf("with a model config: upstream model = %s, want the dotted name normalized", got)
+	}
+}
+
+func TestReloadKeepsPreviousConfig(t *testing.T) {
+	useModelConfig(t, defaultModelConfig)
+	path := filepath.Join(t.TempDir(), "models.yaml")
+	if err := os.WriteFile(path, []byte("aliases:\n  fast:\n    model: deepseek-chat\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadModelConfig(path); err != nil {
+		t.Fatalf("loadModelConfig: %v", err)
+	}
+	loaded := currentModelConfig()
+
+	if err := os.WriteFile(path, []byte("aliases:\n  fast:\n    provider: deepseek\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadModelConfig(path); err == nil {
+		t.Fatal("loadModelConfig accepted an alias without a model")
+	}
+	if currentModelConfig() != loaded {
+		t.Error("a bad config file replaced the active config")
+	}
+	if alias, ok := lookupAlias("fast"); !ok || alias.Model != "deepseek-chat" {
+		t.Errorf("lookupAlias(fast) = %+v, %t after a bad reload", alias, ok)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultModelsCacheTTL is how long an upstream model list is served from
+	// cache; MODELS_CACHE_TTL overrides it
+	defaultModelsCacheTTL = 10 * time.Minute
+	// modelsRetryInterval is how long the static list is used after a failed
+	// fetch before the upstream is asked again
+	modelsRetryInterval = time.Minute
+	modelsFetchTimeout  = 10 * time.Second
+)
+
+// staticModelsCreated is the creation time reported for the built-in model
+// lists, fixed at startup so repeated /v1/models calls agree
+var staticModelsCreated = time.Now().Unix()
+
+// modelListCache holds the last model list fetched from each provider
+type modelListCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[Provider]*modelListEntry
+	// inflight holds the fetches in progress, so concurrent requests for an
+	// expired list wait for one upstream query instead of each sending one
+	inflight map[Provider]chan struct{}
+}
+
+type modelListEntry struct {
+	models []Model
+	// expires is when the upstream should be asked again
+	expires time.Time
+	// fromUpstream is false when models is the provider's static fallback
+	fromUpstream bool
+}
+
+// modelsCache is set up in main once the environment is loaded
+var modelsCache *modelListCache
+
+func newModelListCache(ttl time.Duration) *modelListCache {
+	return &modelListCache{ttl: ttl, entries: map[Provider]*modelListEntry{}, inflight: map[Provider]chan struct{}{}}
+}
+
+func modelsCacheTTL() time.Duration {
+	v := os.Getenv("MODELS_CACHE_TTL")
+	if v == "" {
+		return defaultModelsCacheTTL
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("Invalid MODELS_CACHE_TTL, using the default", "value", v, "default", defaultModelsCacheTTL.String(), "error", err)
+		return defaultModelsCacheTTL
+	}
+	return ttl
+}
+
+// get returns the model list of p, querying the upstream when the cached list
+// has expired. When the upstream cannot be reached the previously fetched list
+// is kept, or the provider's static list is used if there is none. The lock is
+// not held during the query; while one is in flight other callers get the
+// expired list, or wait for the result when there is none yet.
+func (c *modelListCache) get(p Provider) []Model {
+	c.mu.Lock()
+	entry := c.entries[p]
+	if entry != nil && time.Now().Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.models
+	}
+	if done, ok := c.inflight[p]; ok {
+		c.mu.Unlock()
+		if entry != nil {
+			return entry.models
+		}
+		<-done
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.entries[p].models
+	}
+	done := make(chan struct{})
+	c.inflight[p] = done
+	c.mu.Unlock()
+
+	next := c.fetch(p, entry)
+
+	c.mu.Lock()
+	c.entries[p] = next
+	delete(c.inflight, p)
+	c.mu.Unlock()
+	close(done)
+	return next.models
+}
+
+// fetch queries the upstream model list of p and returns the entry replacing
+// prev, the expired one
+func (c *modelListCache) fetch(p Provider, prev *modelListEntry) *modelListEntry {
+	key, ok := p.Keys().peek()
+	if !ok {
+		// Without a server key the upstream list cannot be queried
+		return &modelListEntry{models: p.Models(), expires: time.Now().Add(c.ttl)}
+	}
+
+	models, err := p.FetchModels(key)
+	now := time.Now()
+	switch {
+	case err == nil && len(models) > 0:
+		slog.Info("Fetched upstream models", "provider", p.Name(), "models", len(models))
+		return &modelListEntry{models: models, expires: now.Add(c.ttl), fromUpstream: true}
+	case prev != nil && prev.fromUpstream:
+		slog.Warn("Error fetching models, keeping cached list", "provider", p.Name(), "error", err)
+		return &modelListEntry{models: prev.models, expires: now.Add(modelsRetryInterval), fromUpstream: true}
+	default:
+		if err == nil {
+			err = fmt.Errorf("empty model list")
+		}
+		slog.Warn("Error fetching models, using built-in list", "provider", p.Name(), "error", err)
+		return &modelListEntry{models: p.Models(), expires: now.Add(modelsRetryInterval)}
+	}
+}
+
+// fetchOpenAIModels queries an OpenAI-compatible model list endpoint. Models
+// without an owner are attributed to ownedBy.
+func fetchOpenAIModels(url, apiKey, ownedBy string) ([]Model, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Accept", "application/json")
+
+	body, err := doModelsRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var list ModelsResponse
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("error parsing model list: %v", err)
+	}
+	models := make([]Model, 0, len(list.Data))
+	for _, m := range list.Data {
+		if m.ID == "" {
+			continue
+		}
+		m.Object = "model"
+		if m.OwnedBy == "" {
+			m.OwnedBy = ownedBy
+		}
+		if m.Created == 0 {
+			m.Created = staticModelsCreated
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+// doModelsRequest sends a model list request and returns the body of a
+// successful response
+func doModelsRequest(req *http.Request) ([]byte, error) {
+	// Same pool and proxy as the chat requests, with a short timeout
+	client := &http.Client{Transport: upstreamClient.Transport, Timeout: modelsFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, truncateString(string(body), 200))
+	}
+	return body, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestModelListCache(t *testing.T) {
+	upstream := newMockUpstream(t, upstreamReply{body: `{"object":"list","data":[{"id":"deepseek-chat","object":"model","owned_by":"deepseek"}]}`})
+	pool := newKeyPool("deepseek", keyStrategyRoundRobin, []string{"sk-test-upstream-key"})
+	p := providerSpecs["deepseek"].newProvider(upstream.URL, pool)
+	cache := newModelListCache(time.Hour)
+
+	// Concurrent requests for an empty cache share one upstream query
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if models := cache.get(p); len(models) != 1 || models[0].ID != "deepseek-chat" {
+				t.Errorf("models = %+v, want the upstream list", models)
+			}
+		}()
+	}
+	wg.Wait()
+
+	reqs := upstream.received()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream got %d requests, want 1", len(reqs))
+	}
+	if reqs[0].path != "/models" || reqs[0].header.Get("Authorization") != "Bearer sk-test-upstream-key" {
+		t.Errorf("upstream request = %s with %q", reqs[0].path, reqs[0].header.Get("Authorization"))
+	}
+	if got := pool.status().Keys[0].Requests; got != 0 {
+		t.Errorf("key requests = %d, want model list queries not counted", got)
+	}
+}
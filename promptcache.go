@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	// maxCacheBreakpoints is the most cache_control blocks Anthropic accepts
+	maxCacheBreakpoints = 4
+	// cachedUserTurns is how many of the latest user turns get a breakpoint:
+	// the newest one writes the cache for the next turn, the one before it
+	// reads what the previous turn wrote
+	cachedUserTurns = 2
+)
+
+// promptCaching is set from ANTHROPIC_PROMPT_CACHE in main
+var promptCaching bool
+
+func promptCachingFromEnv() bool {
+	v := os.Getenv("ANTHROPIC_PROMPT_CACHE")
+	if v == "" {
+		return false
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("Invalid ANTHROPIC_PROMPT_CACHE, prompt caching disabled", "value", v)
+		return false
+	}
+	return enabled
+}
+
+func ephemeralCache() map[string]interface{} {
+	return map[string]interface{}{"type": "ephemeral"}
+}
+
+// addCacheBreakpoints marks the stable prefix of an Anthropic request for
+// prompt caching: the tool definitions, the system prompt and the latest user
+// turns, in that order, until maxCacheBreakpoints are used. Breakpoints the
+// client set itself count towards the limit and are not marked twice. Cursor
+// resends the same system prompt and file context every turn, so later turns
+// read it from the cache. It returns the number of breakpoints added.
+func addCacheBreakpoints(req map[string]interface{}) int {
+	used := countCacheBreakpoints(req)
+	added := 0
+	// mark sets a breakpoint on block and reports whether it has one
+	mark := func(block map[string]interface{}) bool {
+		if _, ok := block["cache_control"]; ok {
+			return true
+		}
+		if used >= maxCacheBreakpoints {
+			return false
+		}
+		block["cache_control"] = ephemeralCache()
+		used++
+		added++
+		return true
+	}
+
+	if tools, _ := req["tools"].([]interface{}); len(tools) > 0 {
+		if last, ok := tools[len(tools)-1].(map[string]interface{}); ok {
+			mark(last)
+		}
+	}
+	if system, _ := req["system"].(string); system != "" {
+		block := map[string]interface{}{"type": "text", "text": system}
+		if mark(block) {
+			req["system"] = []interface{}{block}
+		}
+	}
+
+	messages, _ := req["messages"].([]map[string]interface{})
+	turns := 0
+	for i := len(messages) - 1; i >= 0 && turns < cachedUserTurns; i-- {
+		if messages[i]["role"] != "user" {
+			continue
+		}
+		blocks, _ := messages[i]["content"].([]interface{})
+		if len(blocks) == 0 {
+			continue
+		}
+		if last, ok := blocks[len(blocks)-1].(map[string]interface{}); ok {
+			if !mark(last) {
+				break
+			}
+			turns++
+		}
+	}
+	return added
+}
+
+// countCacheBreakpoints counts the cache_control blocks already in a request
+func countCacheBreakpoints(req map[string]interface{}) int {
+	count := 0
+	countBlocks := func(blocks []interface{}) {
+		for _, b := range blocks {
+			if block, ok := b.(map[string]interface{}); ok && block["cache_control"] != nil {
+				count++
+			}
+		}
+	}
+	tools, _ := req["tools"].([]interface{})
+	countBlocks(tools)
+	system, _ := req["system"].([]interface{})
+	countBlocks(system)
+	messages, _ := req["messages"].([]map[string]interface{})
+	for _, m := range messages {
+		content, _ := m["content"].([]interface{})
+		countBlocks(content)
+	}
+	return count
+}
+
+// promptCacheStats totals prompt tokens since startup for the overall hit ratio
+var promptCacheStats struct {
+	mu           sync.Mutex
+	promptTokens int
+	readTokens   int
+}
+
+// logCacheUsage logs how much of a request's prompt was read from and
+// written to the Anthropic prompt cache
+func logCacheUsage(ur *UpstreamRequest) {
+	u := ur.Usage
+	if u == nil || u.PromptTokens == 0 {
+		return
+	}
+	read := u.cachedTokens()
+	if read == 0 && u.CacheWriteTokens == 0 && !promptCaching {
+		return
+	}
+	promptCacheStats.mu.Lock()
+	promptCacheStats.promptTokens += u.PromptTokens
+	promptCacheStats.readTokens += read
+	overall := float64(promptCacheStats.readTokens) / float64(promptCacheStats.promptTokens)
+	promptCacheStats.mu.Unlock()
+
+	ur.logger().Info("Prompt cache usage",
+		"cache_read_tokens", read,
+		"cache_write_tokens", u.CacheWriteTokens,
+		"uncached_tokens", u.PromptTokens-read-u.CacheWriteTokens,
+		"prompt_tokens", u.PromptTokens,
+		"hit_ratio", float64(read)/float64(u.PromptTokens),
+		"overall_hit_ratio", overall)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// cacheBreakpoints lists where an Anthropic request has cache_control blocks
+func cacheBreakpoints(req map[string]interface{}) []string {
+	var out []string
+	tools, _ := req["tools"].([]interface{})
+	for _, t := range tools {
+		if tool := t.(map[string]interface{}); tool["cache_control"] != nil {
+			out = append(out, "tool "+getString(tool, "name"))
+		}
+	}
+	system, _ := req["system"].([]interface{})
+	for _, b := range system {
+		if b.(map[string]interface{})["cache_control"] != nil {
+			out = append(out, "system")
+		}
+	}
+	messages, _ := req["messages"].([]map[string]interface{})
+	for i, m := range messages {
+		content, _ := m["content"].([]interface{})
+		for j, b := range content {
+			if b.(map[string]interface{})["cache_control"] != nil {
+				out = append(out, fmt.Sprintf("message %d block %d", i, j))
+			}
+		}
+	}
+	return out
+}
+
+func TestAddCacheBreakpoints(t *testing.T) {
+	const tools = `"tools":[{"type":"function","function":{"name":"read_file"}},{"type":"function","function":{"name":"edit_file"}}]`
+	const conversation = `{"role":"user","content":"one"},{"role":"assistant","content":"1"},` +
+		`{"role":"user","content":"two"},{"role":"assistant","content":"2"},` +
+		`{"role":"user","content":[{"type":"text","text":"file context"},{"type":"text","text":"three"}]}`
+	tests := []struct {
+		name      string
+		request   string
+		wantAdded int
+		want      []string
+	}{
+		{
+			name:      "tools, system and the last two user turns",
+			request:   `{"model":"claude-sonnet-4-6",` + tools + `,"messages":[{"role":"system","content":"Be brief."},` + conversation + `]}`,
+			wantAdded: 4,
+			want:      []string{"tool edit_file", "system", "message 2 block 0", "message 4 block 1"},
+		},
+		{
+			name:      "without tools",
+			request:   `{"model":"claude-sonnet-4-6","messages":[{"role":"system","content":"Be brief."},` + conversation + `]}`,
+			wantAdded: 3,
+			want:      []string{"system", "message 2 block 0", "message 4 block 1"},
+		},
+		{
+			name:      "single user turn",
+			request:   `{"model":"claude-sonnet-4-6","messages":[{"role":"user","content":"Hi"}]}`,
+			wantAdded: 1,
+			want:      []string{"message 0 block 0"},
+		},
+		{
+			name: "client breakpoints count towards the cap",
+			request: `{"model":"claude-sonnet-4-6",` + tools + `,"messages":[{"role":"system","content":"Be brief."},` +
+				`{"role":"user","content":[{"type":"text","text":"one","cache_control":{"type":"ephemeral"}}]},{"role":"assistant","content":"1"},` +
+				`{"role":"user","content":"two"},{"role":"assistant","content":"2"},` +
+				`{"role":"user","content":[{"type":"text","text":"three","cache_control":{"type":"ephemeral","ttl":"1h"}}]}]}`,
+			wantAdded: 2,
+			want:      []string{"tool edit_file", "system", "message 0 block 0", "message 4 block 0"},
+		},
+		{
+			name: "client breakpoints use up the cap",
+			request: `{"model":"claude-sonnet-4-6",` + tools + `,"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":[` +
+				`{"type":"text","text":"a","cache_control":{"type":"ephemeral"}},{"type":"text","text":"b","cache_control":{"type":"ephemeral"}},` +
+				`{"type":"text","text":"c","cache_control":{"type":"ephemeral"}},{"type":"text","text":"d","cache_control":{"type":"ephemeral"}}]}]}`,
+			wantAdded: 0,
+			want:      []string{"message 0 block 0", "message 0 block 1", "message 0 block 2", "message 0 block 3"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var reqMap map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.request), &reqMap); err != nil {
+				t.Fatal(err)
+			}
+			req, err := convertOpenAIToAnthropic(reqMap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if added := addCacheBreakpoints(req); added != tc.wantAdded {
+				t.Errorf("added = %d, want %d", added, tc.wantAdded)
+			}
+			got := cacheBreakpoints(req)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("breakpoints = %v, want %v", got, tc.want)
+			}
+			if len(got) > maxCacheBreakpoints {
+				t.Errorf("%d breakpoints, Anthropic accepts %d", len(got), maxCacheBreakpoints)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Provider is an upstream backend that OpenAI-style chat completion requests
+// from Cursor are forwarded to.
+type Provider interface {
+	// Name returns the variant name the provider is selected by, e.g. "o2a-max"
+	Name() string
+	// Keys returns the pool of server-side keys used when the client does not
+	// send one
+	Keys() *keyPool
+	// Models returns the built-in model list, used when the upstream list
+	// cannot be fetched
+	Models() []Model
+	// FetchModels queries the upstream for the models it currently serves
+	FetchModels(apiKey string) ([]Model, error)
+	// TranslateRequest converts the client request body into the upstream format
+	TranslateRequest(body []byte) (*UpstreamRequest, error)
+	// Send forwards the translated request to the upstream API
+	Send(r *http.Request, ur *UpstreamRequest, apiKey string) (*http.Response, error)
+	// TranslateResponse converts a regular upstream response into OpenAI format
+	TranslateResponse(w http.ResponseWriter, resp *http.Response, ur *UpstreamRequest)
+	// TranslateStream converts an upstream SSE stream into OpenAI SSE chunks
+	TranslateStream(w http.ResponseWriter, resp *http.Response, ur *UpstreamRequest)
+}
+
+// UpstreamRequest is a client request translated for one provider
+type UpstreamRequest struct {
+	// Model is the model name reported back to the client
+	Model  string
+	Stream bool
+	// IncludeUsage is set when a streaming client asked for the final usage
+	// chunk with stream_options.include_usage
+	IncludeUsage bool
+	Body         []byte
+	// Retries counts the earlier attempts at sending this request
+	Retries int
+	// Usage is filled in by TranslateResponse and TranslateStream when the
+	// upstream reported token usage
+	Usage *OAIUsage
+	// SentAt is when the last attempt was sent upstream and FirstTokenAt when
+	// TranslateStream relayed the first content, for the latency metrics
+	SentAt       time.Time
+	FirstTokenAt time.Time
+	// Log is the logger of the client request, with its request ID
+	Log *slog.Logger
+	// StreamErr is set by TranslateStream when the upstream stream failed
+	// after the response had started, see failStream
+	StreamErr error
+}
+
+// markFirstToken records the time of the first streamed content
+func (ur *UpstreamRequest) markFirstToken() {
+	if ur.FirstTokenAt.IsZero() {
+		ur.FirstTokenAt = time.Now()
+	}
+}
+
+// Models response structure
+type ModelsResponse struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// providerSpec describes how to build a provider from env vars and flags
+type providerSpec struct {
+	name string
+	// keyEnv and endpointEnv name the env vars holding the server key and
+	// endpoint; keyEnv+"S" may hold a comma-separated list of further keys
+	keyEnv          string
+	endpointEnv     string
+	defaultEndpoint string
+	newProvider     func(endpoint string, keys *keyPool) Provider
+}
+
+var providerSpecs = map[string]providerSpec{}
+
+// registerProvider makes a provider selectable by name; called from init()
+func registerProvider(spec providerSpec) {
+	if _, exists := providerSpecs[spec.name]; exists {
+		log.Fatalf("Provider %q registered twice", spec.name)
+	}
+	providerSpecs[spec.name] = spec
+}
+
+func providerNames() []string {
+	names := make([]string, 0, len(providerSpecs))
+	for name := range providerSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
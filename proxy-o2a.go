@@ -1,201 +1,537 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/joho/godotenv"
 )
 
 const (
 	defaultAnthropicEndpoint = "https://api.anthropic.com"
 	anthropicVersion         = "2023-06-01"
 	defaultAnthropicModel    = "claude-sonnet-4-5"
+	// Anthropic requires max_tokens; used when the client does not send one
+	defaultMaxTokens = 8192
 )
 
-var (
-	anthropicAPIKey   string
-	anthropicEndpoint string
-)
-
-// modelNameMap maps client-provided model names to Anthropic API model IDs
+// modelNameMap maps client-provided model names to Anthropic API model IDs.
+// It is the built-in default used while no model config is loaded.
 var modelNameMap = map[string]string{
 	"claude-sonnet-4.6": "claude-sonnet-4-6",
-	"claude-opus-4.6": "claude-sonnet-4-6",
+	"claude-opus-4.6":   "claude-sonnet-4-6",
 	"claude-sonnet-4.5": "gpt-5.3-codex",
 }
 
 func init() {
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: .env file not found: %v", err)
+	registerProvider(providerSpec{
+		name:            "o2a",
+		keyEnv:          "ANTHROPIC_API_KEY",
+		endpointEnv:     "ANTHROPIC_ENDPOINT",
+		defaultEndpoint: defaultAnthropicEndpoint,
+		newProvider: func(endpoint string, keys *keyPool) Provider {
+			return &anthropicProvider{name: "o2a", endpoint: endpoint, keys: keys, modelMap: modelNameMap}
+		},
+	})
+}
+
+// anthropicProvider talks to the Anthropic Messages API, converting between
+// OpenAI and Anthropic formats in both directions
+type anthropicProvider struct {
+	name     string
+	endpoint string
+	keys     *keyPool
+	// modelMap renames client models when no model config is loaded
+	modelMap map[string]string
+	// setHeaders adds variant-specific headers to upstream requests
+	setHeaders func(h http.Header, stream bool, retries int)
+}
+
+func (p *anthropicProvider) Name() string   { return p.name }
+func (p *anthropicProvider) Keys() *keyPool { return p.keys }
+
+func (p *anthropicProvider) TranslateRequest(body []byte) (*UpstreamRequest, error) {
+	// Parse as generic map for field manipulation
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal(body, &reqMap); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	originalModel, _ := reqMap["model"].(string)
+	if originalModel == "" {
+		originalModel = defaultAnthropicModel
+	}
+	if mapped, ok := p.modelMap[originalModel]; ok && !modelConfigLoaded() {
+		reqMap["model"] = mapped
+	} else {
+		reqMap["model"] = normalizeAnthropicModel(originalModel)
 	}
-	anthropicAPIKey = os.Getenv("ANTHROPIC_API_KEY")
-	if anthropicAPIKey == "" {
-		log.Printf("Warning: ANTHROPIC_API_KEY not set, user must provide key in request")
+
+	isStream, _ := reqMap["stream"].(bool)
+	streamOptions, _ := reqMap["stream_options"].(map[string]interface{})
+	includeUsage, _ := streamOptions["include_usage"].(bool)
+
+	anthropicReq, err := convertOpenAIToAnthropic(reqMap)
+	if err != nil {
+		return nil, err
 	}
-	anthropicEndpoint = strings.TrimRight(os.Getenv("ANTHROPIC_ENDPOINT"), "/")
-	if anthropicEndpoint == "" {
-		anthropicEndpoint = defaultAnthropicEndpoint
+	if promptCaching {
+		addCacheBreakpoints(anthropicReq)
 	}
-	log.Printf("Initialized Anthropic proxy, endpoint: %s", anthropicEndpoint)
+
+	modifiedBody, err := json.Marshal(anthropicReq)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing request: %v", err)
+	}
+	return &UpstreamRequest{Model: originalModel, Stream: isStream, IncludeUsage: isStream && includeUsage, Body: modifiedBody}, nil
 }
 
-func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+// normalizeAnthropicModel turns Cursor's dotted Claude names such as
+// "claude-sonnet-4.5" into Anthropic model IDs ("claude-sonnet-4-5"). Other
+// renames come from the built-in model map or the configured model aliases.
+func normalizeAnthropicModel(model string) string {
+	if !strings.HasPrefix(model, "claude-") {
+		return model
+	}
+	return strings.ReplaceAll(model, ".", "-")
+}
 
-	// Command-line flags override env vars
-	flagEndpoint := flag.String("endpoint", "", "Anthropic API endpoint (overrides ANTHROPIC_ENDPOINT)")
-	flagPort := flag.String("port", "", "Listen port (overrides PORT env var)")
-	flagKey := flag.String("key", "", "Anthropic API key (overrides ANTHROPIC_API_KEY)")
-	flag.Parse()
+func (p *anthropicProvider) Send(r *http.Request, ur *UpstreamRequest, apiKey string) (*http.Response, error) {
+	// Forward to Anthropic API
+	proxyReq, err := http.NewRequestWithContext(r.Context(), "POST", p.endpoint+"/v1/messages", bytes.NewReader(ur.Body))
+	if err != nil {
+		return nil, err
+	}
+	proxyReq.Header.Set("x-api-key", apiKey)
+	proxyReq.Header.Set("Authorization", "Bearer "+apiKey)
+	proxyReq.Header.Set("anthropic-version", anthropicVersion)
+	proxyReq.Header.Set("content-type", "application/json")
+	if ur.Stream {
+		proxyReq.Header.Set("accept", "text/event-stream")
+	}
+	if p.setHeaders != nil {
+		p.setHeaders(proxyReq.Header, ur.Stream, ur.Retries)
+	}
 
-	if *flagEndpoint != "" {
-		anthropicEndpoint = strings.TrimRight(*flagEndpoint, "/")
+	return upstreamClient.Do(proxyReq)
+}
+
+// ---- OpenAI → Anthropic request conversion ----
+
+// convertOpenAIToAnthropic builds an Anthropic Messages request from an OpenAI
+// chat completion request. System messages are hoisted to the top-level system
+// field, assistant tool_calls become tool_use blocks and tool messages become
+// tool_result blocks inside user turns. OpenAI-only fields such as
+// stream_options are dropped.
+func convertOpenAIToAnthropic(reqMap map[string]interface{}) (map[string]interface{}, error) {
+	out := map[string]interface{}{
+		"model": reqMap["model"],
 	}
-	if *flagKey != "" {
-		anthropicAPIKey = *flagKey
+
+	maxTokens := int(getFloat(reqMap, "max_tokens"))
+	if maxTokens <= 0 {
+		maxTokens = int(getFloat(reqMap, "max_completion_tokens"))
 	}
+	if maxTokens <= 0 {
+		maxTokens = defaultMaxTokens
+	}
+	out["max_tokens"] = maxTokens
 
-	port := *flagPort
-	if port == "" {
-		port = os.Getenv("PORT")
+	for _, key := range []string{"stream", "temperature", "top_p"} {
+		if v, ok := reqMap[key]; ok && v != nil {
+			out[key] = v
+		}
 	}
-	if port == "" {
-		port = "9000"
+	switch stop := reqMap["stop"].(type) {
+	case string:
+		if stop != "" {
+			out["stop_sequences"] = []string{stop}
+		}
+	case []interface{}:
+		if len(stop) > 0 {
+			out["stop_sequences"] = stop
+		}
+	}
+	if user := getString(reqMap, "user"); user != "" {
+		out["metadata"] = map[string]interface{}{"user_id": user}
 	}
 
-	log.Printf("Using endpoint: %s", anthropicEndpoint)
+	var systemParts []string
+	var messages []map[string]interface{}
+	rawMessages, _ := reqMap["messages"].([]interface{})
+	for _, m := range rawMessages {
+		msg, _ := m.(map[string]interface{})
+		if msg == nil {
+			continue
+		}
+		switch role := getString(msg, "role"); role {
+		case "system", "developer":
+			if text := contentText(msg["content"]); text != "" {
+				systemParts = append(systemParts, text)
+			}
+		case "user":
+			messages = appendAnthropicMessage(messages, "user", convertUserContent(msg["content"]))
+		case "assistant":
+			messages = appendAnthropicMessage(messages, "assistant", convertAssistantContent(msg))
+		case "tool":
+			result := map[string]interface{}{
+				"type":        "tool_result",
+				"tool_use_id": getString(msg, "tool_call_id"),
+			}
+			if text := contentText(msg["content"]); text != "" {
+				result["content"] = text
+			}
+			// Anthropic expects tool results inside the following user turn
+			messages = appendAnthropicMessage(messages, "user", []interface{}{result})
+		default:
+			slog.Warn("Skipping message with unsupported role", "role", role)
+		}
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("request must contain at least one user or assistant message")
+	}
+	out["messages"] = messages
+	if len(systemParts) > 0 {
+		out["system"] = strings.Join(systemParts, "\n\n")
+	}
 
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: http.HandlerFunc(proxyHandler),
+	// Legacy "functions" are accepted the same way as "tools"
+	rawTools, _ := reqMap["tools"].([]interface{})
+	if len(rawTools) == 0 {
+		if functions, ok := reqMap["functions"].([]interface{}); ok {
+			for _, fn := range functions {
+				rawTools = append(rawTools, map[string]interface{}{"type": "function", "function": fn})
+			}
+		}
+	}
+	if tools := convertTools(rawTools); len(tools) > 0 {
+		out["tools"] = tools
+		toolChoice, keepTools := convertToolChoiceToAnthropic(reqMap["tool_choice"], reqMap["parallel_tool_calls"])
+		switch {
+		case keepTools:
+			if toolChoice != nil {
+				out["tool_choice"] = toolChoice
+			}
+		case hasToolBlocks(messages):
+			// History still references tools, so the definitions must stay
+			out["tool_choice"] = map[string]interface{}{"type": "none"}
+		default:
+			delete(out, "tools")
+		}
 	}
 
-	log.Printf("Starting Anthropic proxy on %s", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	if thinking := thinkingConfig(reqMap); thinking != nil && canUseThinking(messages) {
+		enableThinking(out, thinking)
+	} else {
+		stripThinkingBlocks(messages)
 	}
-}
 
-func enableCors(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, anthropic-version, x-api-key")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	return out, nil
 }
 
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received: %s %s", r.Method, r.URL.Path)
+// ---- Extended thinking ----
 
-	if r.Method == "OPTIONS" {
-		enableCors(w)
-		return
-	}
-	enableCors(w)
+// thinkingBudgets maps OpenAI reasoning_effort values to Anthropic thinking budgets
+var thinkingBudgets = map[string]int{
+	"minimal": 1024,
+	"low":     2048,
+	"medium":  8192,
+	"high":    24576,
+}
 
-	// Extract API key
-	authHeader := r.Header.Get("Authorization")
-	apiKey := strings.TrimPrefix(authHeader, "Bearer ")
-	if apiKey == "" || apiKey == authHeader {
-		apiKey = anthropicAPIKey
+// thinkingConfig returns the Anthropic thinking parameter for a request, taken
+// either from a native "thinking" object or from OpenAI's reasoning_effort
+func thinkingConfig(reqMap map[string]interface{}) map[string]interface{} {
+	if thinking, ok := reqMap["thinking"].(map[string]interface{}); ok {
+		if getString(thinking, "type") == "enabled" && getFloat(thinking, "budget_tokens") > 0 {
+			return thinking
+		}
+		return nil
 	}
-	if apiKey == "" {
-		http.Error(w, "No API key provided", http.StatusUnauthorized)
-		return
+	budget, ok := thinkingBudgets[getString(reqMap, "reasoning_effort")]
+	if !ok {
+		return nil
 	}
+	return map[string]interface{}{"type": "enabled", "budget_tokens": budget}
+}
 
-	if r.URL.Path == "/v1/models" && r.Method == "GET" {
-		handleModelsRequest(w)
-		return
+// canUseThinking reports whether thinking can be enabled for this history.
+// Anthropic rejects a tool-use turn that is missing its signed thinking block,
+// which happens when the thinking cache no longer holds it.
+func canUseThinking(messages []map[string]interface{}) bool {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i]["role"] != "assistant" {
+			continue
+		}
+		blocks, _ := messages[i]["content"].([]interface{})
+		if len(blocks) == 0 || !hasBlockType(blocks, "tool_use") {
+			return true
+		}
+		first, _ := blocks[0].(map[string]interface{})
+		if t := getString(first, "type"); t == "thinking" || t == "redacted_thinking" {
+			return true
+		}
+		slog.Warn("Thinking blocks for previous tool call not found, disabling thinking for this request")
+		return false
 	}
+	return true
+}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Error reading request", http.StatusBadRequest)
-		return
+// enableThinking turns on extended thinking and adjusts parameters that
+// Anthropic does not allow together with it
+func enableThinking(out map[string]interface{}, thinking map[string]interface{}) {
+	out["thinking"] = thinking
+	budget := int(getFloat(thinking, "budget_tokens"))
+	if maxTokens, _ := out["max_tokens"].(int); maxTokens <= budget {
+		out["max_tokens"] = budget + defaultMaxTokens
 	}
-	defer r.Body.Close()
-
-	// Parse as generic map for field manipulation
-	var reqMap map[string]interface{}
-	if err := json.Unmarshal(body, &reqMap); err != nil {
-		log.Printf("Error parsing request JSON: %v", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	delete(out, "temperature")
+	delete(out, "top_p")
+	// Forcing a tool is not supported while thinking
+	if choice, ok := out["tool_choice"].(map[string]interface{}); ok {
+		if t := getString(choice, "type"); t == "any" || t == "tool" {
+			choice["type"] = "auto"
+			delete(choice, "name")
+		}
 	}
+}
 
-	// Apply model name mapping
-	originalModel, _ := reqMap["model"].(string)
-	if originalModel == "" {
-		originalModel = defaultAnthropicModel
-		reqMap["model"] = originalModel
+// stripThinkingBlocks removes replayed thinking blocks when thinking is off
+func stripThinkingBlocks(messages []map[string]interface{}) {
+	for _, msg := range messages {
+		blocks, _ := msg["content"].([]interface{})
+		kept := blocks[:0]
+		for _, b := range blocks {
+			block, _ := b.(map[string]interface{})
+			if t := getString(block, "type"); t == "thinking" || t == "redacted_thinking" {
+				continue
+			}
+			kept = append(kept, b)
+		}
+		if len(blocks) > 0 {
+			msg["content"] = kept
+		}
 	}
-	if mapped, ok := modelNameMap[originalModel]; ok {
-		reqMap["model"] = mapped
+}
+
+func hasBlockType(blocks []interface{}, blockType string) bool {
+	for _, b := range blocks {
+		if block, ok := b.(map[string]interface{}); ok && getString(block, "type") == blockType {
+			return true
+		}
 	}
+	return false
+}
 
-	// Remove stream_options (OpenAI extension, not supported by Anthropic)
-	delete(reqMap, "stream_options")
+// thinkingStore remembers signed thinking blocks by the tool call IDs that
+// followed them. OpenAI clients never send reasoning back, but Anthropic needs
+// those blocks replayed on the next turn of a tool-use loop.
+type thinkingStore struct {
+	mu     sync.Mutex
+	blocks map[string][]interface{}
+	order  []string
+}
 
-	isStream, _ := reqMap["stream"].(bool)
+const maxThinkingEntries = 1024
 
-	modifiedBody, err := json.Marshal(reqMap)
-	if err != nil {
-		http.Error(w, "Error serializing request", http.StatusInternalServerError)
+var thinkingCache = &thinkingStore{blocks: map[string][]interface{}{}}
+
+func (s *thinkingStore) put(toolCallIDs []string, blocks []interface{}) {
+	if len(toolCallIDs) == 0 || len(blocks) == 0 {
 		return
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range toolCallIDs {
+		if _, exists := s.blocks[id]; !exists {
+			s.order = append(s.order, id)
+		}
+		s.blocks[id] = blocks
+	}
+	for len(s.order) > maxThinkingEntries {
+		delete(s.blocks, s.order[0])
+		s.order = s.order[1:]
+	}
+}
 
-	// Forward to Anthropic API
-	proxyReq, err := http.NewRequest("POST", anthropicEndpoint+"/v1/messages", bytes.NewReader(modifiedBody))
-	if err != nil {
-		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
-		return
+func (s *thinkingStore) get(toolCallID string) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blocks[toolCallID]
+}
+
+// appendAnthropicMessage adds content blocks for role, merging them into the
+// previous message when it has the same role since Anthropic requires the
+// conversation to alternate between user and assistant.
+func appendAnthropicMessage(messages []map[string]interface{}, role string, blocks []interface{}) []map[string]interface{} {
+	if len(blocks) == 0 {
+		return messages
 	}
-	proxyReq.Header.Set("x-api-key", apiKey)
-	proxyReq.Header.Set("Authorization", "Bearer "+apiKey)
-	proxyReq.Header.Set("anthropic-version", anthropicVersion)
-	proxyReq.Header.Set("content-type", "application/json")
-	if isStream {
-		proxyReq.Header.Set("accept", "text/event-stream")
+	if n := len(messages); n > 0 && messages[n-1]["role"] == role {
+		prev, _ := messages[n-1]["content"].([]interface{})
+		messages[n-1]["content"] = append(prev, blocks...)
+		return messages
 	}
+	return append(messages, map[string]interface{}{"role": role, "content": blocks})
+}
 
-	client := &http.Client{Timeout: 5 * time.Minute}
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		log.Printf("Error forwarding: %v", err)
-		http.Error(w, "Error forwarding request", http.StatusBadGateway)
-		return
+// contentText flattens OpenAI message content (string or array of parts) to text
+func contentText(content interface{}) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case []interface{}:
+		var texts []string
+		for _, p := range c {
+			if part, ok := p.(map[string]interface{}); ok && getString(part, "type") == "text" {
+				if text := getString(part, "text"); text != "" {
+					texts = append(texts, text)
+				}
+			}
+		}
+		return strings.Join(texts, "\n")
 	}
-	defer resp.Body.Close()
+	return ""
+}
 
-	log.Printf("Anthropic response status: %d", resp.StatusCode)
+func convertUserContent(content interface{}) []interface{} {
+	switch c := content.(type) {
+	case string:
+		if c == "" {
+			return nil
+		}
+		return []interface{}{map[string]interface{}{"type": "text", "text": c}}
+	case []interface{}:
+		var blocks []interface{}
+		for _, p := range c {
+			part, _ := p.(map[string]interface{})
+			if part == nil {
+				continue
+			}
+			switch getString(part, "type") {
+			case "text":
+				// Anthropic rejects empty text blocks
+				if text := getString(part, "text"); text != "" {
+					block := map[string]interface{}{"type": "text", "text": text}
+					// Keep the client's own prompt caching breakpoints
+					if cc, ok := part["cache_control"].(map[string]interface{}); ok {
+						block["cache_control"] = cc
+					}
+					blocks = append(blocks, block)
+				}
+			case "image_url":
+				if img := convertImagePart(part); img != nil {
+					blocks = append(blocks, img)
+				}
+			}
+		}
+		return blocks
+	}
+	return nil
+}
 
-	if resp.StatusCode >= 400 {
-		respBody, _ := io.ReadAll(resp.Body)
-		log.Printf("Anthropic error: %s", string(respBody))
-		for k, v := range resp.Header {
-			w.Header()[k] = v
+// convertImagePart converts an OpenAI image_url part (data URL or remote URL)
+// into an Anthropic image block
+func convertImagePart(part map[string]interface{}) map[string]interface{} {
+	var url string
+	switch v := part["image_url"].(type) {
+	case string:
+		url = v
+	case map[string]interface{}:
+		url = getString(v, "url")
+	}
+	if url == "" {
+		return nil
+	}
+	if strings.HasPrefix(url, "data:") {
+		// data:<media_type>;base64,<data>
+		meta, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+		if !ok {
+			return nil
+		}
+		return map[string]interface{}{
+			"type": "image",
+			"source": map[string]interface{}{
+				"type":       "base64",
+				"media_type": strings.TrimSuffix(meta, ";base64"),
+				"data":       data,
+			},
 		}
-		w.WriteHeader(resp.StatusCode)
-		w.Write(respBody)
-		return
 	}
+	return map[string]interface{}{
+		"type":   "image",
+		"source": map[string]interface{}{"type": "url", "url": url},
+	}
+}
 
-	if isStream {
-		handleStreamingResponse(w, resp, originalModel)
-		return
+func convertAssistantContent(msg map[string]interface{}) []interface{} {
+	var blocks []interface{}
+	toolCalls, _ := msg["tool_calls"].([]interface{})
+	// Replay the signed thinking that preceded these tool calls; it must come first
+	for _, tc := range toolCalls {
+		if call, ok := tc.(map[string]interface{}); ok {
+			if thinking := thinkingCache.get(getString(call, "id")); thinking != nil {
+				blocks = append(blocks, thinking...)
+				break
+			}
+		}
+	}
+	if text := contentText(msg["content"]); text != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+	}
+	for _, tc := range toolCalls {
+		call, _ := tc.(map[string]interface{})
+		fn, _ := call["function"].(map[string]interface{})
+		if fn == nil {
+			continue
+		}
+		var input map[string]interface{}
+		if args := getString(fn, "arguments"); strings.TrimSpace(args) != "" {
+			if err := json.Unmarshal([]byte(args), &input); err != nil {
+				slog.Warn("Invalid arguments for tool call", "tool_call_id", getString(call, "id"), "error", err)
+			}
+		}
+		if input == nil {
+			input = map[string]interface{}{}
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    getString(call, "id"),
+			"name":  getString(fn, "name"),
+			"input": input,
+		})
 	}
-	handleRegularResponse(w, resp, originalModel)
+	return blocks
+}
+
+// convertTools converts OpenAI function tools to Anthropic tool definitions
+func convertTools(tools []interface{}) []interface{} {
+	var out []interface{}
+	for _, t := range tools {
+		tool, _ := t.(map[string]interface{})
+		fn, _ := tool["function"].(map[string]interface{})
+		if fn == nil {
+			continue
+		}
+		schema, _ := fn["parameters"].(map[string]interface{})
+		if schema == nil {
+			schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		def := map[string]interface{}{
+			"name":         getString(fn, "name"),
+			"input_schema": schema,
+		}
+		if desc := getString(fn, "description"); desc != "" {
+			def["description"] = desc
+		}
+		out = append(out, def)
+	}
+	return out
 }
 
 // ---- OpenAI response structures ----
@@ -216,9 +552,10 @@ type OAIChoice struct {
 }
 
 type OAIMessage struct {
-	Role      string        `json:"role"`
-	Content   string        `json:"content,omitempty"`
-	ToolCalls []OAIToolCall `json:"tool_calls,omitempty"`
+	Role             string        `json:"role"`
+	Content          string        `json:"content,omitempty"`
+	ReasoningContent string        `json:"reasoning_content,omitempty"`
+	ToolCalls        []OAIToolCall `json:"tool_calls,omitempty"`
 }
 
 type OAIToolCall struct {
@@ -232,9 +569,42 @@ type OAIToolCall struct {
 }
 
 type OAIUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens        int                     `json:"prompt_tokens"`
+	CompletionTokens    int                     `json:"completion_tokens"`
+	TotalTokens         int                     `json:"total_tokens"`
+	PromptTokensDetails *OAIPromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+	// CacheWriteTokens counts the prompt tokens written to Anthropic's prompt
+	// cache, which OpenAI usage has no field for
+	CacheWriteTokens int `json:"-"`
+}
+
+type OAIPromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+// cachedTokens returns the prompt tokens read from the upstream prompt cache
+func (u *OAIUsage) cachedTokens() int {
+	if u.PromptTokensDetails == nil {
+		return 0
+	}
+	return u.PromptTokensDetails.CachedTokens
+}
+
+// anthropicUsage converts Anthropic token counts to OpenAI usage. Anthropic's
+// input_tokens excludes cached tokens while OpenAI's prompt_tokens includes
+// them, so cache reads and writes are added back in.
+func anthropicUsage(inputTokens, cacheReadTokens, cacheWriteTokens, outputTokens int) *OAIUsage {
+	promptTokens := inputTokens + cacheReadTokens + cacheWriteTokens
+	u := &OAIUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: outputTokens,
+		TotalTokens:      promptTokens + outputTokens,
+		CacheWriteTokens: cacheWriteTokens,
+	}
+	if cacheReadTokens > 0 {
+		u.PromptTokensDetails = &OAIPromptTokensDetails{CachedTokens: cacheReadTokens}
+	}
+	return u
 }
 
 type OAIStreamChunk struct {
@@ -243,6 +613,8 @@ type OAIStreamChunk struct {
 	Created int64             `json:"created"`
 	Model   string            `json:"model"`
 	Choices []OAIStreamChoice `json:"choices"`
+	// Usage is only set on the final chunk, which has no choices
+	Usage *OAIUsage `json:"usage,omitempty"`
 }
 
 type OAIStreamChoice struct {
@@ -252,31 +624,38 @@ type OAIStreamChoice struct {
 }
 
 type OAIDelta struct {
-	Role      string        `json:"role,omitempty"`
-	Content   string        `json:"content,omitempty"`
-	ToolCalls []OAIToolCall `json:"tool_calls,omitempty"`
+	Role             string        `json:"role,omitempty"`
+	Content          string        `json:"content,omitempty"`
+	ReasoningContent string        `json:"reasoning_content,omitempty"`
+	ToolCalls        []OAIToolCall `json:"tool_calls,omitempty"`
 }
 
-// handleRegularResponse converts Anthropic response to OpenAI format
-func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalModel string) {
+// TranslateResponse converts Anthropic response to OpenAI format
+func (p *anthropicProvider) TranslateResponse(w http.ResponseWriter, resp *http.Response, ur *UpstreamRequest) {
+	originalModel := ur.Model
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, "Error reading response", http.StatusInternalServerError)
+		if clientGone(resp) {
+			ur.logger().Info("Client disconnected, upstream response closed")
+			return
+		}
+		ur.logger().Error("Error reading response", "error", err)
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "", "Error reading the upstream response")
 		return
 	}
 	var aResp map[string]interface{}
 	if err := json.Unmarshal(body, &aResp); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		w.Write(body)
+		ur.logger().Error("Error parsing Anthropic response", "error", err, "body", truncateForLog(body))
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "", "Invalid response from the upstream")
 		return
 	}
 
 	msgID, _ := aResp["id"].(string)
 	stopReason, _ := aResp["stop_reason"].(string)
 
-	var textParts []string
+	var textParts, reasoningParts []string
 	var toolCalls []OAIToolCall
+	var thinkingBlocks []interface{}
 	if content, ok := aResp["content"].([]interface{}); ok {
 		for _, c := range content {
 			block, _ := c.(map[string]interface{})
@@ -288,6 +667,11 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 				if t, ok := block["text"].(string); ok {
 					textParts = append(textParts, t)
 				}
+			case "thinking":
+				reasoningParts = append(reasoningParts, getString(block, "thinking"))
+				thinkingBlocks = append(thinkingBlocks, block)
+			case "redacted_thinking":
+				thinkingBlocks = append(thinkingBlocks, block)
 			case "tool_use":
 				inputJSON, _ := json.Marshal(block["input"])
 				toolCalls = append(toolCalls, OAIToolCall{
@@ -305,17 +689,28 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 		}
 	}
 
-	msg := OAIMessage{Role: "assistant", Content: strings.Join(textParts, "\n")}
+	msg := OAIMessage{
+		Role:             "assistant",
+		Content:          strings.Join(textParts, "\n"),
+		ReasoningContent: strings.Join(reasoningParts, "\n"),
+	}
 	if len(toolCalls) > 0 {
 		msg.ToolCalls = toolCalls
+		toolCallIDs := make([]string, len(toolCalls))
+		for i, tc := range toolCalls {
+			toolCallIDs[i] = tc.ID
+		}
+		thinkingCache.put(toolCallIDs, thinkingBlocks)
 	}
 
-	var promptTokens, completionTokens int
-	if usage, ok := aResp["usage"].(map[string]interface{}); ok {
-		promptTokens = int(getFloat(usage, "input_tokens"))
-		completionTokens = int(getFloat(usage, "output_tokens"))
-	}
-
+	usage, _ := aResp["usage"].(map[string]interface{})
+	ur.Usage = anthropicUsage(
+		int(getFloat(usage, "input_tokens")),
+		int(getFloat(usage, "cache_read_input_tokens")),
+		int(getFloat(usage, "cache_creation_input_tokens")),
+		int(getFloat(usage, "output_tokens")),
+	)
+	logCacheUsage(ur)
 	oaiResp := OAIResponse{
 		ID:      msgID,
 		Object:  "chat.completion",
@@ -326,11 +721,7 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 			Message:      msg,
 			FinishReason: convertStopReason(stopReason),
 		}},
-		Usage: OAIUsage{
-			PromptTokens:     promptTokens,
-			CompletionTokens: completionTokens,
-			TotalTokens:      promptTokens + completionTokens,
-		},
+		Usage: *ur.Usage,
 	}
 
 	out, _ := json.Marshal(oaiResp)
@@ -339,8 +730,9 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 	w.Write(out)
 }
 
-// handleStreamingResponse converts Anthropic SSE → OpenAI SSE
-func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, originalModel string) {
+// TranslateStream converts Anthropic SSE → OpenAI SSE
+func (p *anthropicProvider) TranslateStream(w http.ResponseWriter, resp *http.Response, ur *UpstreamRequest) {
+	originalModel := ur.Model
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -351,6 +743,14 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, origina
 	created := time.Now().Unix()
 
 	var msgID string
+	// Usage arrives split: input and cache tokens in message_start, output in
+	// message_delta
+	var inputTokens, cacheReadTokens, cacheWriteTokens, completionTokens int
+	recordUsage := func() {
+		if inputTokens > 0 || cacheReadTokens > 0 || cacheWriteTokens > 0 || completionTokens > 0 {
+			ur.Usage = anthropicUsage(inputTokens, cacheReadTokens, cacheWriteTokens, completionTokens)
+		}
+	}
 
 	// Track tool_use blocks by content index
 	type toolBlock struct {
@@ -361,6 +761,25 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, origina
 	toolBlocks := map[int]*toolBlock{}
 	toolCallCount := 0
 
+	// Thinking blocks are collected with their signatures so they can be
+	// replayed upstream on the next turn of a tool-use loop
+	thinkingBlocks := map[int]map[string]interface{}{}
+	var thinkingOrder []int
+	rememberThinking := func() {
+		if len(toolBlocks) == 0 || len(thinkingOrder) == 0 {
+			return
+		}
+		blocks := make([]interface{}, 0, len(thinkingOrder))
+		for _, idx := range thinkingOrder {
+			blocks = append(blocks, thinkingBlocks[idx])
+		}
+		ids := make([]string, 0, len(toolBlocks))
+		for _, tb := range toolBlocks {
+			ids = append(ids, tb.id)
+		}
+		thinkingCache.put(ids, blocks)
+	}
+
 	sendChunk := func(chunk OAIStreamChunk) {
 		data, err := json.Marshal(chunk)
 		if err != nil {
@@ -372,19 +791,45 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, origina
 		}
 	}
 
-	reader := bufio.NewReader(resp.Body)
+	// finish ends the stream, sending the usage chunk first when the client
+	// asked for it with stream_options.include_usage
+	finish := func() {
+		rememberThinking()
+		recordUsage()
+		logCacheUsage(ur)
+		if ur.IncludeUsage && ur.Usage != nil {
+			sendChunk(OAIStreamChunk{
+				ID: msgID, Object: "chat.completion.chunk", Created: created, Model: originalModel,
+				Choices: []OAIStreamChoice{}, Usage: ur.Usage,
+			})
+		}
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	stream := newSSEReader(resp.Body, w)
+	defer stream.Close()
 	var eventType string
 
 	for {
-		line, err := reader.ReadString('\n')
+		raw, err := stream.ReadLine()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			log.Printf("Stream read error: %v", err)
-			break
+			if clientGone(resp) {
+				ur.logger().Info("Client disconnected, upstream stream closed")
+				recordUsage()
+				return
+			}
+			ur.logger().Error("Error reading stream", "error", err)
+			recordUsage()
+			failStream(w, ur, streamInterrupted())
+			return
 		}
-		line = strings.TrimRight(line, "\r\n")
+		line := strings.TrimRight(string(raw), "\r\n")
 
 		if line == "" {
 			eventType = ""
@@ -408,6 +853,12 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, origina
 		case "message_start":
 			if msg, ok := event["message"].(map[string]interface{}); ok {
 				msgID, _ = msg["id"].(string)
+				if usage, ok := msg["usage"].(map[string]interface{}); ok {
+					inputTokens = int(getFloat(usage, "input_tokens"))
+					cacheReadTokens = int(getFloat(usage, "cache_read_input_tokens"))
+					cacheWriteTokens = int(getFloat(usage, "cache_creation_input_tokens"))
+					completionTokens = int(getFloat(usage, "output_tokens"))
+				}
 			}
 			// Send initial role chunk
 			sendChunk(OAIStreamChunk{
@@ -421,7 +872,15 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, origina
 			if cb == nil {
 				continue
 			}
-			if getString(cb, "type") == "tool_use" {
+			switch getString(cb, "type") {
+			case "thinking":
+				thinkingBlocks[idx] = map[string]interface{}{"type": "thinking", "thinking": "", "signature": ""}
+				thinkingOrder = append(thinkingOrder, idx)
+			case "redacted_thinking":
+				thinkingBlocks[idx] = map[string]interface{}{"type": "redacted_thinking", "data": getString(cb, "data")}
+				thinkingOrder = append(thinkingOrder, idx)
+			case "tool_use":
+				ur.markFirstToken()
 				oaiIdx := toolCallCount
 				toolCallCount++
 				toolBlocks[idx] = &toolBlock{
@@ -449,6 +908,7 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, origina
 			if delta == nil {
 				continue
 			}
+			ur.markFirstToken()
 			switch getString(delta, "type") {
 			case "text_delta":
 				text, _ := delta["text"].(string)
@@ -456,6 +916,19 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, origina
 					ID: msgID, Object: "chat.completion.chunk", Created: created, Model: originalModel,
 					Choices: []OAIStreamChoice{{Index: 0, Delta: OAIDelta{Content: text}}},
 				})
+			case "thinking_delta":
+				thinking, _ := delta["thinking"].(string)
+				if tb, ok := thinkingBlocks[idx]; ok {
+					tb["thinking"] = getString(tb, "thinking") + thinking
+				}
+				sendChunk(OAIStreamChunk{
+					ID: msgID, Object: "chat.completion.chunk", Created: created, Model: originalModel,
+					Choices: []OAIStreamChoice{{Index: 0, Delta: OAIDelta{ReasoningContent: thinking}}},
+				})
+			case "signature_delta":
+				if tb, ok := thinkingBlocks[idx]; ok {
+					tb["signature"] = getString(tb, "signature") + getString(delta, "signature")
+				}
 			case "input_json_delta":
 				partial, _ := delta["partial_json"].(string)
 				if tb, ok := toolBlocks[idx]; ok {
@@ -476,6 +949,10 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, origina
 			}
 
 		case "message_delta":
+			if usage, ok := event["usage"].(map[string]interface{}); ok {
+				// output_tokens here is cumulative for the whole message
+				completionTokens = int(getFloat(usage, "output_tokens"))
+			}
 			delta, _ := event["delta"].(map[string]interface{})
 			if delta == nil {
 				continue
@@ -487,19 +964,29 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, origina
 				Choices: []OAIStreamChoice{{Index: 0, Delta: OAIDelta{}, FinishReason: &finishReason}},
 			})
 
+		case "ping":
+			// Anthropic's own keepalive, passed on for the proxies in between
+			stream.Heartbeat()
+
+		case "error":
+			// e.g. overloaded_error after part of the answer has been sent
+			upstreamErr, _ := event["error"].(map[string]interface{})
+			e := anthropicStreamError(upstreamErr)
+			ur.logger().Error("Upstream stream error", "type", e.Code, "message", e.Message)
+			recordUsage()
+			failStream(w, ur, e)
+			return
+
 		case "message_stop":
-			fmt.Fprintf(w, "data: [DONE]\n\n")
-			if flusher != nil {
-				flusher.Flush()
-			}
+			finish()
 			return
 		}
 	}
 
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	if flusher != nil {
-		flusher.Flush()
-	}
+	// The stream ended without message_stop
+	ur.logger().Error("Upstream stream ended early")
+	recordUsage()
+	failStream(w, ur, streamInterrupted())
 }
 
 func convertStopReason(reason string) string {
@@ -515,6 +1002,63 @@ func convertStopReason(reason string) string {
 	}
 }
 
+// convertToolChoiceToAnthropic maps OpenAI tool_choice and parallel_tool_calls
+// onto Anthropic's tool_choice. A nil result leaves the upstream default (auto)
+// in place; keepTools is false for "none", which callers handle by dropping the
+// tool definitions.
+func convertToolChoiceToAnthropic(choice interface{}, parallelToolCalls interface{}) (result map[string]interface{}, keepTools bool) {
+	switch c := choice.(type) {
+	case string:
+		switch c {
+		case "none":
+			return nil, false
+		case "auto":
+			result = map[string]interface{}{"type": "auto"}
+		case "required", "any":
+			result = map[string]interface{}{"type": "any"}
+		}
+	case map[string]interface{}:
+		switch getString(c, "type") {
+		case "none":
+			return nil, false
+		case "auto", "any":
+			result = map[string]interface{}{"type": getString(c, "type")}
+		default:
+			// {"type":"function","function":{"name":...}} or Anthropic-style {"type":"tool","name":...}
+			name := getString(c, "name")
+			if fn, ok := c["function"].(map[string]interface{}); ok {
+				name = getString(fn, "name")
+			}
+			if name != "" {
+				result = map[string]interface{}{"type": "tool", "name": name}
+			}
+		}
+	}
+
+	if parallel, ok := parallelToolCalls.(bool); ok && !parallel {
+		if result == nil {
+			result = map[string]interface{}{"type": "auto"}
+		}
+		result["disable_parallel_tool_use"] = true
+	}
+	return result, true
+}
+
+// hasToolBlocks reports whether any message carries tool_use or tool_result blocks
+func hasToolBlocks(messages []map[string]interface{}) bool {
+	for _, msg := range messages {
+		blocks, _ := msg["content"].([]interface{})
+		for _, b := range blocks {
+			if block, ok := b.(map[string]interface{}); ok {
+				if t := getString(block, "type"); t == "tool_use" || t == "tool_result" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 func getFloat(m map[string]interface{}, key string) float64 {
 	if v, ok := m[key].(float64); ok {
 		return v
@@ -529,16 +1073,52 @@ func getString(m map[string]interface{}, key string) string {
 	return ""
 }
 
-func handleModelsRequest(w http.ResponseWriter) {
-	response := map[string]interface{}{
-		"object": "list",
-		"data": []map[string]interface{}{
-			{"id": "claude-opus-4-6", "object": "model", "created": time.Now().Unix(), "owned_by": "anthropic"},
-			{"id": "claude-sonnet-4-6", "object": "model", "created": time.Now().Unix(), "owned_by": "anthropic"},
-			{"id": "claude-sonnet-4-5", "object": "model", "created": time.Now().Unix(), "owned_by": "anthropic"},
-			{"id": "claude-haiku-4-5-20251001", "object": "model", "created": time.Now().Unix(), "owned_by": "anthropic"},
-		},
+func (p *anthropicProvider) Models() []Model {
+	created := staticModelsCreated
+	return []Model{
+		{ID: "claude-opus-4-6", Object: "model", Created: created, OwnedBy: "anthropic"},
+		{ID: "claude-sonnet-4-6", Object: "model", Created: created, OwnedBy: "anthropic"},
+		{ID: "claude-sonnet-4-5", Object: "model", Created: created, OwnedBy: "anthropic"},
+		{ID: "claude-haiku-4-5-20251001", Object: "model", Created: created, OwnedBy: "anthropic"},
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+}
+
+// FetchModels lists the models from the Anthropic /v1/models endpoint
+func (p *anthropicProvider) FetchModels(apiKey string) ([]Model, error) {
+	req, err := http.NewRequest("GET", p.endpoint+"/v1/models?limit=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+	if p.setHeaders != nil {
+		p.setHeaders(req.Header, false, 0)
+	}
+
+	body, err := doModelsRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Data []struct {
+			ID        string `json:"id"`
+			CreatedAt string `json:"created_at"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("error parsing model list: %v", err)
+	}
+	models := make([]Model, 0, len(list.Data))
+	for _, m := range list.Data {
+		if m.ID == "" {
+			continue
+		}
+		created := staticModelsCreated
+		if t, err := time.Parse(time.RFC3339, m.CreatedAt); err == nil {
+			created = t.Unix()
+		}
+		models = append(models, Model{ID: m.ID, Object: "model", Created: created, OwnedBy: "anthropic"})
+	}
+	return models, nil
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// convertRequest runs convertOpenAIToAnthropic on a JSON request and returns
+// the result decoded as generic JSON
+func convertRequest(t *testing.T, request string) map[string]interface{} {
+	t.Helper()
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal([]byte(request), &reqMap); err != nil {
+		t.Fatal(err)
+	}
+	out, err := convertOpenAIToAnthropic(reqMap)
+	if err != nil {
+		t.Fatalf("convertOpenAIToAnthropic: %v", err)
+	}
+	data, _ := json.Marshal(out)
+	var decoded map[string]interface{}
+	json.Unmarshal(data, &decoded)
+	return decoded
+}
+
+func TestConvertToolChoice(t *testing.T) {
+	const (
+		tools       = `"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}]`
+		userTurn    = `{"role":"user","content":"Weather in Paris?"}`
+		toolHistory = userTurn + `,` +
+			`{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{}"}}]},` +
+			`{"role":"tool","tool_call_id":"call_1","content":"Sunny"}`
+	)
+	tests := []struct {
+		name    string
+		choice  string
+		history string
+		// wantChoice is the Anthropic tool_choice, empty when it is left unset
+		wantChoice string
+		wantTools  bool
+	}{
+		{name: "unset", wantTools: true},
+		{name: "auto", choice: `"tool_choice":"auto"`, wantChoice: `{"type":"auto"}`, wantTools: true},
+		{name: "required", choice: `"tool_choice":"required"`, wantChoice: `{"type":"any"}`, wantTools: true},
+		{
+			name:       "named function",
+			choice:     `"tool_choice":{"type":"function","function":{"name":"get_weather"}}`,
+			wantChoice: `{"type":"tool","name":"get_weather"}`,
+			wantTools:  true,
+		},
+		{
+			name:       "parallel tool calls disabled",
+			choice:     `"parallel_tool_calls":false`,
+			wantChoice: `{"type":"auto","disable_parallel_tool_use":true}`,
+			wantTools:  true,
+		},
+		{
+			name:       "required without parallel tool calls",
+			choice:     `"tool_choice":"required","parallel_tool_calls":false`,
+			wantChoice: `{"type":"any","disable_parallel_tool_use":true}`,
+			wantTools:  true,
+		},
+		{name: "parallel tool calls enabled", choice: `"parallel_tool_calls":true`, wantTools: true},
+		{name: "none drops the tools", choice: `"tool_choice":"none"`},
+		{
+			name:       "none with tool blocks in the history",
+			choice:     `"tool_choice":"none"`,
+			history:    toolHistory,
+			wantChoice: `{"type":"none"}`,
+			wantTools:  true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			history := tc.history
+			if history == "" {
+				history = userTurn
+			}
+			request := `{"model":"claude-sonnet-4-5","messages":[` + history + `],` + tools
+			if tc.choice != "" {
+				request += `,` + tc.choice
+			}
+			out := convertRequest(t, request+`}`)
+
+			if _, ok := out["tools"]; ok != tc.wantTools {
+				t.Errorf("tools sent = %t, want %t", ok, tc.wantTools)
+			}
+			choice, ok := out["tool_choice"]
+			switch {
+			case tc.wantChoice == "" && ok:
+				t.Errorf("tool_choice = %v, want it unset", choice)
+			case tc.wantChoice != "":
+				got, _ := json.Marshal(choice)
+				if canonicalJSON(t, string(got)) != canonicalJSON(t, tc.wantChoice) {
+					t.Errorf("tool_choice = %s, want %s", got, tc.wantChoice)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertOpenAIToAnthropic(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		// want holds the expected JSON of each listed field of the result
+		want map[string]string
+		// absent lists fields that must not be sent upstream
+		absent []string
+	}{
+		{
+			name:    "defaults",
+			request: `{"model":"claude-sonnet-4-5","stream":true,"stream_options":{"include_usage":true},"stop":"END","user":"u-1","messages":[{"role":"user","content":"Hi"}]}`,
+			want: map[string]string{
+				"max_tokens":     `8192`,
+				"stream":         `true`,
+				"stop_sequences": `["END"]`,
+				"metadata":       `{"user_id":"u-1"}`,
+				"messages":       `[{"role":"user","content":[{"type":"text","text":"Hi"}]}]`,
+			},
+			absent: []string{"stream_options", "system", "tools", "tool_choice"},
+		},
+		{
+			name:    "max_completion_tokens",
+			request: `{"model":"claude-sonnet-4-5","max_completion_tokens":1000,"messages":[{"role":"user","content":"Hi"}]}`,
+			want:    map[string]string{"max_tokens": `1000`},
+		},
+		{
+			name: "system and developer messages hoisted",
+			request: `{"model":"claude-sonnet-4-5","messages":[` +
+				`{"role":"system","content":"Be brief."},` +
+				`{"role":"developer","content":[{"type":"text","text":"Answer in French."}]},` +
+				`{"role":"user","content":"Hi"}]}`,
+			want: map[string]string{
+				"system":   `"Be brief.\n\nAnswer in French."`,
+				"messages": `[{"role":"user","content":[{"type":"text","text":"Hi"}]}]`,
+			},
+		},
+		{
+			name: "tool calls and results",
+			request: `{"model":"claude-sonnet-4-5","messages":[` +
+				`{"role":"user","content":"Weather in Paris and Rome?"},` +
+				`{"role":"assistant","content":"Checking.","tool_calls":[` +
+				`{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}},` +
+				`{"id":"call_2","type":"function","function":{"name":"get_weather","arguments":"{\"city\":"}}]},` +
+				`{"role":"tool","tool_call_id":"call_1","content":"Sunny"},` +
+				`{"role":"tool","tool_call_id":"call_2","content":[{"type":"text","text":"Rain"}]},` +
+				`{"role":"user","content":"Thanks"}]}`,
+			want: map[string]string{
+				"messages": `[` +
+					`{"role":"user","content":[{"type":"text","text":"Weather in Paris and Rome?"}]},` +
+					`{"role":"assistant","content":[` +
+					`{"type":"text","text":"Checking."},` +
+					`{"type":"tool_use","id":"call_1","name":"get_weather","input":{"city":"Paris"}},` +
+					`{"type":"tool_use","id":"call_2","name":"get_weather","input":{}}]},` +
+					`{"role":"user","content":[` +
+					`{"type":"tool_result","tool_use_id":"call_1","content":"Sunny"},` +
+					`{"type":"tool_result","tool_use_id":"call_2","content":"Rain"},` +
+					`{"type":"text","text":"Thanks"}]}]`,
+			},
+		},
+		{
+			name: "tools",
+			request: `{"model":"claude-sonnet-4-5","messages":[{"role":"user","content":"Hi"}],"tools":[` +
+				`{"type":"function","function":{"name":"get_weather","description":"Current weather","parameters":{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}}},` +
+				`{"type":"function","function":{"name":"get_time"}}]}`,
+			want: map[string]string{
+				"tools": `[` +
+					`{"name":"get_weather","description":"Current weather","input_schema":{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}},` +
+					`{"name":"get_time","input_schema":{"type":"object","properties":{}}}]`,
+			},
+		},
+		{
+			name:    "legacy functions",
+			request: `{"model":"claude-sonnet-4-5","messages":[{"role":"user","content":"Hi"}],"functions":[{"name":"get_time","parameters":{"type":"object"}}]}`,
+			want:    map[string]string{"tools": `[{"name":"get_time","input_schema":{"type":"object"}}]`},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out := convertRequest(t, tc.request)
+			for field, want := range tc.want {
+				got, _ := json.Marshal(out[field])
+				if canonicalJSON(t, string(got)) != canonicalJSON(t, want) {
+					t.Errorf("%s = %s, want %s", field, got, want)
+				}
+			}
+			for _, field := range tc.absent {
+				if v, ok := out[field]; ok {
+					t.Errorf("%s = %v, want it dropped", field, v)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertOpenAIToAnthropicNeedsMessages(t *testing.T) {
+	var reqMap map[string]interface{}
+	json.Unmarshal([]byte(`{"model":"claude-sonnet-4-5","messages":[{"role":"system","content":"Be brief."}]}`), &reqMap)
+	if _, err := convertOpenAIToAnthropic(reqMap); err == nil {
+		t.Error("a request with only a system message was accepted")
+	}
+}
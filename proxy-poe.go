@@ -1,46 +1,42 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"compress/flate"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
-	"os"
 	"strings"
-	"time"
-
-	"github.com/andybalholm/brotli"
-	"github.com/joho/godotenv"
 )
 
 const (
-	openAIEndpoint      = "https://api.poe.com" // POE的OpenAI兼容endpoint
-	claudeSonnetModel   = "claude-sonnet-4.5"
-	defaultOpenAIModel  = "claude-sonnet-4.5" // 默认使用POE的Claude模型
+	openAIEndpoint     = "https://api.poe.com" // POE的OpenAI兼容endpoint
+	claudeSonnetModel  = "claude-sonnet-4.5"
+	defaultOpenAIModel = "claude-sonnet-4.5" // 默认使用POE的Claude模型
 )
 
-var poeAPIKey string
-
 func init() {
-	// 加载 .env 文件
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: .env file not found or error loading it: %v", err)
-	}
+	registerProvider(providerSpec{
+		name:            "poe",
+		keyEnv:          "POE_API_KEY",
+		endpointEnv:     "POE_ENDPOINT",
+		defaultEndpoint: openAIEndpoint,
+		newProvider:     newPoeProvider,
+	})
+}
 
-	// 获取 POE API key
-	poeAPIKey = os.Getenv("POE_API_KEY")
-	if poeAPIKey == "" {
-		log.Printf("Warning: POE_API_KEY environment variable is not set, user must provide API key in request")
-	}
+// poeProvider 对接 POE 的 OpenAI 兼容接口，支持 Claude 系列模型
+type poeProvider struct {
+	endpoint string
+	keys     *keyPool
+}
 
-	log.Printf("Initialized Claude to POE proxy with endpoint: %s", openAIEndpoint)
+func newPoeProvider(endpoint string, keys *keyPool) Provider {
+	return &poeProvider{endpoint: endpoint, keys: keys}
 }
 
+func (p *poeProvider) Name() string   { return "poe" }
+func (p *poeProvider) Keys() *keyPool { return p.keys }
+
 // Claude 请求结构
 type ClaudeRequest struct {
 	Model         string                 `json:"model"`
@@ -56,11 +52,11 @@ type ClaudeRequest struct {
 }
 
 type ClaudeMessage struct {
-	Role       string             `json:"role"`
-	Content    json.RawMessage    `json:"content,omitempty"`
-	ToolCalls  []ClaudeToolCall   `json:"tool_calls,omitempty"`
-	ToolCallID string             `json:"tool_call_id,omitempty"`
-	Name       string             `json:"name,omitempty"`
+	Role       string           `json:"role"`
+	Content    json.RawMessage  `json:"content,omitempty"`
+	ToolCalls  []ClaudeToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+	Name       string           `json:"name,omitempty"`
 }
 
 type ClaudeContentPart struct {
@@ -101,26 +97,27 @@ type ClaudeToolCall struct {
 
 // OpenAI 请求结构
 type OpenAIRequest struct {
-	Model       string                 `json:"model"`
-	Messages    []OpenAIMessage        `json:"messages"`
-	MaxTokens   *int                   `json:"max_tokens,omitempty"`
-	Temperature *float64               `json:"temperature,omitempty"`
-	Stream      bool                   `json:"stream"`
-	Tools       []OpenAITool           `json:"tools,omitempty"`
-	ToolChoice  interface{}            `json:"tool_choice,omitempty"`
+	Model         string          `json:"model"`
+	Messages      []OpenAIMessage `json:"messages"`
+	MaxTokens     *int            `json:"max_tokens,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	Stream        bool            `json:"stream"`
+	StreamOptions *StreamOptions  `json:"stream_options,omitempty"`
+	Tools         []OpenAITool    `json:"tools,omitempty"`
+	ToolChoice    interface{}     `json:"tool_choice,omitempty"`
 }
 
 type OpenAIMessage struct {
-	Role       string             `json:"role"`
-	Content    interface{}        `json:"content,omitempty"`
-	ToolCalls  []OpenAIToolCall   `json:"tool_calls,omitempty"`
-	ToolCallID string             `json:"tool_call_id,omitempty"`
-	Name       string             `json:"name,omitempty"`
+	Role       string           `json:"role"`
+	Content    interface{}      `json:"content,omitempty"`
+	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+	Name       string           `json:"name,omitempty"`
 }
 
 type OpenAITool struct {
-	Type     string       `json:"type"`
-	Function OpenAIFunc   `json:"function"`
+	Type     string     `json:"type"`
+	Function OpenAIFunc `json:"function"`
 }
 
 type OpenAIFunc struct {
@@ -140,12 +137,12 @@ type OpenAIToolCall struct {
 
 // OpenAI 响应结构
 type OpenAIResponse struct {
-	ID      string          `json:"id"`
-	Object  string          `json:"object"`
-	Created int64           `json:"created"`
-	Model   string          `json:"model"`
-	Choices []OpenAIChoice  `json:"choices"`
-	Usage   OpenAIUsage     `json:"usage"`
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []OpenAIChoice `json:"choices"`
+	Usage   OpenAIUsage    `json:"usage"`
 }
 
 type OpenAIChoice struct {
@@ -155,164 +152,51 @@ type OpenAIChoice struct {
 }
 
 type OpenAIUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
-}
-
-func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
-
-	// 从环境变量读取端口，如果没有设置则使用默认端口9000
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "9000"
-	}
-
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: http.HandlerFunc(proxyHandler),
-	}
-
-	log.Printf("Starting Claude to OpenAI proxy server on %s", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %v", err)
-	}
+	PromptTokens        int                     `json:"prompt_tokens"`
+	CompletionTokens    int                     `json:"completion_tokens"`
+	TotalTokens         int                     `json:"total_tokens"`
+	PromptTokensDetails *OAIPromptTokensDetails `json:"prompt_tokens_details,omitempty"`
 }
 
-func enableCors(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-}
-
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received request: %s %s", r.Method, r.URL.Path)
-
-	if r.Method == "OPTIONS" {
-		enableCors(w)
-		return
-	}
-
-	enableCors(w)
-
-	// 验证 API key
-	authHeader := r.Header.Get("Authorization")
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		log.Printf("Missing or invalid Authorization header")
-		http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-		return
-	}
-
-	// 优先使用用户传来的 API Key，若为空则回退到环境变量中的 poeAPIKey
-	userAPIKey := strings.TrimPrefix(authHeader, "Bearer ")
-	activeAPIKey := userAPIKey
-	if activeAPIKey == "" {
-		activeAPIKey = poeAPIKey
-	}
-	if activeAPIKey == "" {
-		log.Printf("No API key available: neither user-provided nor POE_API_KEY env var is set")
-		http.Error(w, "No API key available", http.StatusUnauthorized)
-		return
-	}
-
-	// 处理 /v1/models 端点
-	if r.URL.Path == "/v1/models" && r.Method == "GET" {
-		handleModelsRequest(w)
-		return
-	}
-
-	// 读取请求体
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Error reading request", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
+func (p *poeProvider) TranslateRequest(body []byte) (*UpstreamRequest, error) {
 	// 解析 Claude 格式请求
 	var claudeReq ClaudeRequest
 	if err := json.Unmarshal(body, &claudeReq); err != nil {
-		log.Printf("Error parsing Claude request JSON: %v", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+		return nil, fmt.Errorf("invalid JSON: %v", err)
 	}
 
 	// 转换为 OpenAI 格式
 	openAIReq, err := convertClaudeToOpenAI(claudeReq)
 	if err != nil {
-		log.Printf("Error converting request: %v", err)
-		http.Error(w, "Error converting request", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// 创建新的请求体
 	modifiedBody, err := json.Marshal(openAIReq)
 	if err != nil {
-		log.Printf("Error creating modified request body: %v", err)
-		http.Error(w, "Error creating modified request", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error creating modified request: %v", err)
 	}
+	includeUsage, _ := claudeReq.StreamOptions["include_usage"].(bool)
+	return &UpstreamRequest{Model: claudeReq.Model, Stream: claudeReq.Stream, IncludeUsage: claudeReq.Stream && includeUsage, Body: modifiedBody}, nil
+}
 
-	// 创建代理请求到 OpenAI
-	targetURL := openAIEndpoint + "/v1/chat/completions"
-	proxyReq, err := http.NewRequest("POST", targetURL, bytes.NewReader(modifiedBody))
+func (p *poeProvider) Send(r *http.Request, ur *UpstreamRequest, apiKey string) (*http.Response, error) {
+	// 创建代理请求到 POE
+	targetURL := p.endpoint + "/v1/chat/completions"
+	proxyReq, err := http.NewRequestWithContext(r.Context(), "POST", targetURL, bytes.NewReader(ur.Body))
 	if err != nil {
-		log.Printf("Error creating proxy request: %v", err)
-		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// 设置请求头
-	proxyReq.Header.Set("Authorization", "Bearer "+activeAPIKey)
+	proxyReq.Header.Set("Authorization", "Bearer "+apiKey)
 	proxyReq.Header.Set("Content-Type", "application/json")
-	if claudeReq.Stream {
+	if ur.Stream {
 		proxyReq.Header.Set("Accept", "text/event-stream")
 	}
 
-	// 创建客户端并发送请求
-	client := &http.Client{
-		Timeout: 5 * time.Minute,
-	}
-
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		log.Printf("Error forwarding request: %v", err)
-		http.Error(w, "Error forwarding request", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	// 处理错误响应
-	if resp.StatusCode >= 400 {
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Error reading error response: %v", err)
-			http.Error(w, "Error reading response", http.StatusInternalServerError)
-			return
-		}
-		log.Printf("OpenAI ERROR Response: %s", string(respBody))
-
-		// 转发错误响应
-		for k, v := range resp.Header {
-			w.Header()[k] = v
-		}
-		w.WriteHeader(resp.StatusCode)
-		w.Write(respBody)
-		return
-	}
-
-	// 处理流式响应
-	if claudeReq.Stream {
-		handleStreamingResponse(w, resp, claudeReq.Model)
-		return
-	}
-
-	// 处理普通响应
-	handleRegularResponse(w, resp, claudeReq.Model)
+	// 通过共享的上游客户端发送请求
+	return upstreamClient.Do(proxyReq)
 }
 
 // 转换 Claude 请求为 OpenAI 请求
@@ -329,6 +213,10 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest) (*OpenAIRequest, error) {
 		Temperature: claudeReq.Temperature,
 		MaxTokens:   claudeReq.MaxTokens,
 	}
+	if claudeReq.Stream {
+		// 始终请求 usage chunk 以便记账，客户端未要求时由 handleOpenAIStream 丢弃
+		openAIReq.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
 
 	// 转换消息
 	var messages []OpenAIMessage
@@ -509,107 +397,48 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest) (*OpenAIRequest, error) {
 }
 
 // 处理流式响应
-func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, originalModel string) {
-	// 设置流式响应头
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.WriteHeader(resp.StatusCode)
-
-	reader := bufio.NewReader(resp.Body)
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		log.Printf("Warning: ResponseWriter does not support Flush")
-	}
-
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Error reading stream: %v", err)
-			return
-		}
-
-		lineStr := string(line)
-
-		// 转发空行
-		if len(strings.TrimSpace(lineStr)) == 0 {
-			w.Write(line)
-			if flusher != nil {
-				flusher.Flush()
-			}
-			continue
-		}
-
-		// 处理 SSE data 行
-		if strings.HasPrefix(lineStr, "data: ") {
-			data := strings.TrimPrefix(lineStr, "data: ")
-			data = strings.TrimSpace(data)
-
-			// 处理 [DONE] 标记
-			if data == "[DONE]" {
-				w.Write([]byte("data: [DONE]\n\n"))
-				if flusher != nil {
-					flusher.Flush()
-				}
-				break
-			}
-
-			// 解析并修改 JSON，替换模型名称为原始请求的模型
-			var chunk map[string]interface{}
-			if err := json.Unmarshal([]byte(data), &chunk); err == nil {
-				chunk["model"] = originalModel
-
-				modifiedData, err := json.Marshal(chunk)
-				if err == nil {
-					w.Write([]byte("data: "))
-					w.Write(modifiedData)
-					w.Write([]byte("\n\n"))
-				} else {
-					w.Write(line)
-				}
-			} else {
-				w.Write(line)
-			}
-		} else {
-			// 转发其他行
-			w.Write(line)
-		}
-
-		if flusher != nil {
-			flusher.Flush()
-		}
-	}
+func (p *poeProvider) TranslateStream(w http.ResponseWriter, resp *http.Response, ur *UpstreamRequest) {
+	handleOpenAIStream(w, resp, ur)
 }
 
 // 处理普通响应
-func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalModel string) {
+func (p *poeProvider) TranslateResponse(w http.ResponseWriter, resp *http.Response, ur *UpstreamRequest) {
+	originalModel := ur.Model
+
 	// 读取响应体
 	body, err := readResponse(resp)
 	if err != nil {
-		log.Printf("Error reading response: %v", err)
-		http.Error(w, "Error reading response from upstream", http.StatusInternalServerError)
+		if clientGone(resp) {
+			ur.logger().Info("Client disconnected, upstream response closed")
+			return
+		}
+		ur.logger().Error("Error reading response", "error", err)
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "", "Error reading the upstream response")
 		return
 	}
 
 	// 解析 OpenAI 响应
 	var openAIResp OpenAIResponse
 	if err := json.Unmarshal(body, &openAIResp); err != nil {
-		log.Printf("Error parsing OpenAI response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		ur.logger().Error("Error parsing OpenAI response", "error", err, "body", truncateForLog(body))
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "", "Invalid response from the upstream")
 		return
 	}
 
 	// 替换模型名称为原始请求的模型
 	openAIResp.Model = originalModel
+	ur.Usage = &OAIUsage{
+		PromptTokens:        openAIResp.Usage.PromptTokens,
+		CompletionTokens:    openAIResp.Usage.CompletionTokens,
+		TotalTokens:         openAIResp.Usage.TotalTokens,
+		PromptTokensDetails: openAIResp.Usage.PromptTokensDetails,
+	}
 
 	// 转换回 JSON
 	modifiedBody, err := json.Marshal(openAIResp)
 	if err != nil {
-		log.Printf("Error creating modified response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		ur.logger().Error("Error creating modified response", "error", err)
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "", "Error serializing the response")
 		return
 	}
 
@@ -619,41 +448,19 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 	w.Write(modifiedBody)
 }
 
-// 处理模型列表请求
-func handleModelsRequest(w http.ResponseWriter) {
-	response := map[string]interface{}{
-		"object": "list",
-		"data": []map[string]interface{}{
-			{
-				"id":       claudeSonnetModel,
-				"object":   "model",
-				"created":  time.Now().Unix(),
-				"owned_by": "anthropic",
-			},
+// 模型列表
+func (p *poeProvider) Models() []Model {
+	return []Model{
+		{
+			ID:      claudeSonnetModel,
+			Object:  "model",
+			Created: staticModelsCreated,
+			OwnedBy: "anthropic",
 		},
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
 }
 
-// 读取响应（处理压缩）
-func readResponse(resp *http.Response) ([]byte, error) {
-	var reader io.Reader = resp.Body
-
-	switch resp.Header.Get("Content-Encoding") {
-	case "gzip":
-		gzReader, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("error creating gzip reader: %v", err)
-		}
-		defer gzReader.Close()
-		reader = gzReader
-	case "br":
-		reader = brotli.NewReader(resp.Body)
-	case "deflate":
-		reader = flate.NewReader(resp.Body)
-	}
-
-	return io.ReadAll(reader)
+// FetchModels lists the models from POE's OpenAI-compatible /v1/models endpoint
+func (p *poeProvider) FetchModels(apiKey string) ([]Model, error) {
+	return fetchOpenAIModels(p.endpoint+"/v1/models", apiKey, "poe")
 }
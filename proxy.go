@@ -1,21 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"compress/flate"
-	"compress/gzip"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"strings"
-	"time"
-
-	"github.com/andybalholm/brotli"
-	"github.com/joho/godotenv"
 )
 
 const (
@@ -26,71 +19,41 @@ const (
 	deepseekReasonerModel = "deepseek-reasoner"
 )
 
-var deepseekAPIKey string
-
-// Configuration structure
-type Config struct {
-	endpoint string
-	model    string
-}
-
-var activeConfig Config
+// deepseekModelFlag selects the DeepSeek model family; coder uses the beta endpoint
+var deepseekModelFlag = flag.String("model", "chat", "DeepSeek model: chat | coder")
 
 func init() {
-	// Load .env file
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: .env file not found or error loading it: %v", err)
-	}
-
-	// Get DeepSeek API key (optional, can be provided in request header)
-	deepseekAPIKey = os.Getenv("DEEPSEEK_API_KEY")
-	if deepseekAPIKey == "" {
-		log.Printf("Warning: DEEPSEEK_API_KEY environment variable not set, will require API key in request headers")
-	}
+	registerProvider(providerSpec{
+		name:            "deepseek",
+		keyEnv:          "DEEPSEEK_API_KEY",
+		endpointEnv:     "DEEPSEEK_ENDPOINT",
+		defaultEndpoint: deepseekEndpoint,
+		newProvider:     newDeepSeekProvider,
+	})
+}
 
-	// Parse command line arguments
-	modelFlag := "chat" // default value
-	for i, arg := range os.Args {
-		if arg == "-model" && i+1 < len(os.Args) {
-			modelFlag = os.Args[i+1]
-		}
-	}
+// deepSeekProvider talks to the DeepSeek API, which is OpenAI-compatible
+type deepSeekProvider struct {
+	endpoint string
+	keys     *keyPool
+}
 
-	// Configure the active endpoint and model based on the flag
-	switch modelFlag {
+func newDeepSeekProvider(endpoint string, keys *keyPool) Provider {
+	// Configure the endpoint based on the -model flag
+	switch *deepseekModelFlag {
 	case "coder":
-		activeConfig = Config{
-			endpoint: deepseekBetaEndpoint,
-			model:    deepseekCoderModel,
+		if endpoint == deepseekEndpoint {
+			endpoint = deepseekBetaEndpoint
 		}
 	case "chat":
-		activeConfig = Config{
-			endpoint: deepseekEndpoint,
-			model:    deepseekChatModel,
-		}
 	default:
-		log.Printf("Invalid model specified: %s. Using default chat model.", modelFlag)
-		activeConfig = Config{
-			endpoint: deepseekEndpoint,
-			model:    deepseekChatModel,
-		}
+		slog.Warn("Invalid model specified, using default chat model", "model", *deepseekModelFlag)
 	}
-
-	log.Printf("Initialized with model: %s using endpoint: %s", activeConfig.model, activeConfig.endpoint)
-}
-
-// Models response structure
-type ModelsResponse struct {
-	Object string  `json:"object"`
-	Data   []Model `json:"data"`
+	return &deepSeekProvider{endpoint: endpoint, keys: keys}
 }
 
-type Model struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
-}
+func (p *deepSeekProvider) Name() string   { return "deepseek" }
+func (p *deepSeekProvider) Keys() *keyPool { return p.keys }
 
 // OpenAI compatible request structure
 type ChatRequest struct {
@@ -102,6 +65,12 @@ type ChatRequest struct {
 	ToolChoice  interface{} `json:"tool_choice,omitempty"`
 	Temperature *float64    `json:"temperature,omitempty"`
 	MaxTokens   *int        `json:"max_tokens,omitempty"`
+	// StreamOptions.IncludeUsage asks for a final chunk with the usage
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type Message struct {
@@ -110,6 +79,8 @@ type Message struct {
 	ToolCalls  []ToolCall      `json:"tool_calls,omitempty"`
 	ToolCallID string          `json:"tool_call_id,omitempty"`
 	Name       string          `json:"name,omitempty"`
+	// ReasoningContent is the chain of thought returned by deepseek-reasoner
+	ReasoningContent string `json:"reasoning_content,omitempty"`
 }
 
 // ContentPart represents a part of multimodal content
@@ -200,6 +171,10 @@ func convertMessages(messages []Message) []Message {
 	for i, msg := range messages {
 		converted[i] = msg
 
+		// DeepSeek rejects history messages carrying reasoning_content, so it
+		// is removed before forwarding
+		converted[i].ReasoningContent = ""
+
 		// Convert array-format content to string format for DeepSeek
 		// DeepSeek only supports string content, not multimodal arrays
 		contentStr := msg.GetContentString()
@@ -215,7 +190,7 @@ func convertMessages(messages []Message) []Message {
 					Type:     "function",
 					Function: tc.Function,
 				}
-				}
+			}
 			converted[i].ToolCalls = toolCalls
 		}
 
@@ -238,125 +213,27 @@ func truncateString(s string, maxLen int) string {
 
 // DeepSeek request structure
 type DeepSeekRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Tools       []Tool    `json:"tools,omitempty"`
-	ToolChoice  string    `json:"tool_choice,omitempty"`
-}
-
-func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
-
-	// 从环境变量读取端口，如果没有设置则使用默认端口9000
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "9000"
-	}
-
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: http.HandlerFunc(proxyHandler),
-	}
-
-	log.Printf("Starting proxy server on %s", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %v", err)
-	}
+	Model         string         `json:"model"`
+	Messages      []Message      `json:"messages"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	Temperature   float64        `json:"temperature,omitempty"`
+	MaxTokens     int            `json:"max_tokens,omitempty"`
+	Tools         []Tool         `json:"tools,omitempty"`
+	ToolChoice    string         `json:"tool_choice,omitempty"`
 }
 
-func enableCors(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-}
-
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received request: %s %s", r.Method, r.URL.Path)
-
-	if r.Method == "OPTIONS" {
-		enableCors(w)
-		return
-	}
-
-	enableCors(w)
-
-	// 提取用户传来的 API Key，若未提供则回退到服务器环境变量的 key
-	authHeader := r.Header.Get("Authorization")
-	userAPIKey := strings.TrimPrefix(authHeader, "Bearer ")
-	if userAPIKey == "" || userAPIKey == authHeader {
-		// 未携带 Bearer token，使用服务器 key
-		if deepseekAPIKey == "" {
-			log.Printf("Error: No API key provided in request and no server API key configured")
-			http.Error(w, "API key required: please provide Authorization header or configure DEEPSEEK_API_KEY environment variable", http.StatusUnauthorized)
-			return
-		}
-		userAPIKey = deepseekAPIKey
-	} else {
-	}
-
-	// Handle /v1/models endpoint
-	if r.URL.Path == "/v1/models" && r.Method == "GET" {
-		handleModelsRequest(w)
-		return
-	}
-
-	// Read and log request body for debugging
+func (p *deepSeekProvider) TranslateRequest(body []byte) (*UpstreamRequest, error) {
 	var chatReq ChatRequest
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Error reading request", http.StatusBadRequest)
-		return
-	}
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
-
 	if err := json.Unmarshal(body, &chatReq); err != nil {
-		log.Printf("Error parsing request JSON: %v", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
-	}
-
-	// Handle models endpoint
-	if r.URL.Path == "/v1/models" || r.URL.Path == "/models" {
-		handleModelsRequest(w)
-		return
+		return nil, fmt.Errorf("invalid JSON: %v", err)
 	}
 
-	// Normalize path - support both /v1/chat/completions and /chat/completions
-	requestPath := r.URL.Path
-	if !strings.HasPrefix(requestPath, "/v1/") {
-		// Add /v1/ prefix if not present
-		requestPath = "/v1" + requestPath
-	}
-
-	// Only handle chat completions
-	if requestPath != "/v1/chat/completions" {
-		log.Printf("Invalid path: %s (normalized: %s)", r.URL.Path, requestPath)
-		http.Error(w, "Not found", http.StatusNotFound)
-		return
-	}
-
-	// Restore the body for further reading
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
-
-	// Parse the request to check for streaming - reuse existing chatReq
-	if err := json.Unmarshal(body, &chatReq); err != nil {
-		log.Printf("Error parsing request JSON: %v", err)
-		http.Error(w, "Error parsing request", http.StatusBadRequest)
-		return
-	}
-
-	// 使用用户请求的模型，若为空则默认 deepseek-chat
+	// Use the model the client asked for, deepseek-chat when none is given
 	requestModel := chatReq.Model
 	if requestModel == "" {
 		requestModel = deepseekChatModel
 	}
-	originalModel := requestModel
 
 	// Convert to DeepSeek request format
 	deepseekReq := DeepSeekRequest{
@@ -364,6 +241,11 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		Messages: convertMessages(chatReq.Messages),
 		Stream:   chatReq.Stream,
 	}
+	if chatReq.Stream {
+		// Always ask for the usage chunk so streamed requests are accounted;
+		// handleOpenAIStream drops it unless the client asked for it too
+		deepseekReq.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
 
 	// Copy optional parameters if present
 	if chatReq.Temperature != nil {
@@ -399,77 +281,61 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	// Create new request body
 	modifiedBody, err := json.Marshal(deepseekReq)
 	if err != nil {
-		log.Printf("Error creating modified request body: %v", err)
-		http.Error(w, "Error creating modified request", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error creating modified request: %v", err)
 	}
+	includeUsage := chatReq.StreamOptions != nil && chatReq.StreamOptions.IncludeUsage
+	return &UpstreamRequest{Model: requestModel, Stream: chatReq.Stream, IncludeUsage: chatReq.Stream && includeUsage, Body: modifiedBody}, nil
+}
 
-	// 发送请求，若失败则回退到 reasoner 模型
-	resp, usedModel, err := doDeepSeekRequestWithFallback(r, modifiedBody, deepseekReq, chatReq.Stream, userAPIKey)
+func (p *deepSeekProvider) Send(r *http.Request, ur *UpstreamRequest, apiKey string) (*http.Response, error) {
+	proxyReq, err := p.buildHTTPRequest(r, ur.Body, ur.Stream, apiKey)
 	if err != nil {
-		log.Printf("Error forwarding request: %v", err)
-		http.Error(w, "Error forwarding request", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	// 若实际使用了 fallback 模型，originalModel 跟随更新
-	if usedModel != requestModel {
-		log.Printf("Fell back to model: %s (original request: %s)", usedModel, requestModel)
-		originalModel = usedModel
-	}
-
-	// Handle error responses
-	if resp.StatusCode >= 400 {
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Error reading error response: %v", err)
-			http.Error(w, "Error reading response", http.StatusInternalServerError)
-			return
-		}
-
-		// Forward the error response
-		for k, v := range resp.Header {
-			w.Header()[k] = v
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		w.Write(respBody)
-		return
-	}
-
-	// Handle streaming response
-	if chatReq.Stream {
-		handleStreamingResponse(w, r, resp, originalModel)
-		return
+		return nil, err
 	}
+	return upstreamClient.Do(proxyReq)
+}
 
-	// Handle regular response
-	handleRegularResponse(w, resp, originalModel)
+func (p *deepSeekProvider) TranslateStream(w http.ResponseWriter, resp *http.Response, ur *UpstreamRequest) {
+	handleOpenAIStream(w, resp, ur)
 }
 
-func handleStreamingResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, originalModel string) {
+// handleOpenAIStream forwards an OpenAI-compatible SSE stream, replacing the
+// model name in every chunk with the one the client asked for. A usage object
+// sent by the upstream is recorded in ur.Usage; the final usage-only chunk is
+// passed on only when the client set stream_options.include_usage.
+func handleOpenAIStream(w http.ResponseWriter, resp *http.Response, ur *UpstreamRequest) {
+	originalModel := ur.Model
+
 	// Set headers for streaming response
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.WriteHeader(resp.StatusCode)
 
-	// Create a buffered reader for the response body
-	reader := bufio.NewReader(resp.Body)
+	// Read the response body line by line, with heartbeats while it is silent
+	stream := newSSEReader(resp.Body, w)
+	defer stream.Close()
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		log.Printf("Warning: ResponseWriter does not support Flush")
+		ur.logger().Warn("ResponseWriter does not support Flush")
 	}
 
 	for {
-		line, err := reader.ReadBytes('\n')
+		line, err := stream.ReadLine()
 		if err != nil {
+			if clientGone(resp) {
+				ur.logger().Info("Client disconnected, upstream stream closed")
+				return
+			}
 			if err == io.EOF {
-				break
+				// The stream ended without [DONE]
+				ur.logger().Error("Upstream stream ended early")
+				failStream(w, ur, streamInterrupted())
+				return
 			}
-			log.Printf("Error reading stream: %v", err)
+			ur.logger().Error("Error reading stream", "error", err)
+			failStream(w, ur, streamInterrupted())
 			return
 		}
 
@@ -498,11 +364,32 @@ func handleStreamingResponse(w http.ResponseWriter, r *http.Request, resp *http.
 				break
 			}
 
-			// Parse and modify the JSON to replace model name
+			// Parse and modify the JSON to replace model name; reasoner
+			// reasoning_content deltas are passed through with the chunk
 			var chunk map[string]interface{}
 			if err := json.Unmarshal([]byte(data), &chunk); err == nil {
+				if upstreamErr, ok := chunk["error"].(map[string]interface{}); ok {
+					// Map the upstream error like the o2a variants do and end
+					// the stream there
+					e := openAIStreamError(upstreamErr, []byte(data))
+					ur.logger().Error("Upstream stream error", "error", e.Error())
+					failStream(w, ur, e)
+					return
+				}
 				// Replace model name with original requested model
 				chunk["model"] = originalModel
+				if hasDeltaContent(chunk) {
+					ur.markFirstToken()
+				}
+				if usage, ok := chunk["usage"].(map[string]interface{}); ok {
+					ur.Usage = openAIUsage(usage)
+					if choices, _ := chunk["choices"].([]interface{}); len(choices) == 0 && !ur.IncludeUsage {
+						continue
+					}
+					if _, ok := usage["prompt_tokens_details"]; !ok && ur.Usage.PromptTokensDetails != nil {
+						usage["prompt_tokens_details"] = ur.Usage.PromptTokensDetails
+					}
+				}
 
 				// Re-serialize
 				modifiedData, err := json.Marshal(chunk)
@@ -529,12 +416,49 @@ func handleStreamingResponse(w http.ResponseWriter, r *http.Request, resp *http.
 	}
 }
 
-func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalModel string) {
+// hasDeltaContent reports whether a stream chunk carries generated content
+func hasDeltaContent(chunk map[string]interface{}) bool {
+	choices, _ := chunk["choices"].([]interface{})
+	for _, c := range choices {
+		choice, _ := c.(map[string]interface{})
+		delta, _ := choice["delta"].(map[string]interface{})
+		if getString(delta, "content") != "" || getString(delta, "reasoning_content") != "" || delta["tool_calls"] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// openAIUsage reads an OpenAI-style usage object. Cached prompt tokens come
+// from prompt_tokens_details, or DeepSeek's prompt_cache_hit_tokens.
+func openAIUsage(usage map[string]interface{}) *OAIUsage {
+	u := &OAIUsage{
+		PromptTokens:     int(getFloat(usage, "prompt_tokens")),
+		CompletionTokens: int(getFloat(usage, "completion_tokens")),
+		TotalTokens:      int(getFloat(usage, "total_tokens")),
+	}
+	cached := int(getFloat(usage, "prompt_cache_hit_tokens"))
+	if details, ok := usage["prompt_tokens_details"].(map[string]interface{}); ok {
+		cached = int(getFloat(details, "cached_tokens"))
+	}
+	if cached > 0 {
+		u.PromptTokensDetails = &OAIPromptTokensDetails{CachedTokens: cached}
+	}
+	return u
+}
+
+func (p *deepSeekProvider) TranslateResponse(w http.ResponseWriter, resp *http.Response, ur *UpstreamRequest) {
+	originalModel := ur.Model
+
 	// Read and log response body
 	body, err := readResponse(resp)
 	if err != nil {
-		log.Printf("Error reading response: %v", err)
-		http.Error(w, "Error reading response from upstream", http.StatusInternalServerError)
+		if clientGone(resp) {
+			ur.logger().Info("Client disconnected, upstream response closed")
+			return
+		}
+		ur.logger().Error("Error reading response", "error", err)
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "", "Error reading the upstream response")
 		return
 	}
 
@@ -550,15 +474,17 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 			FinishReason string  `json:"finish_reason"`
 		} `json:"choices"`
 		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
+			PromptTokens          int `json:"prompt_tokens"`
+			CompletionTokens      int `json:"completion_tokens"`
+			TotalTokens           int `json:"total_tokens"`
+			PromptCacheHitTokens  int `json:"prompt_cache_hit_tokens,omitempty"`
+			PromptCacheMissTokens int `json:"prompt_cache_miss_tokens,omitempty"`
 		} `json:"usage"`
 	}
 
 	if err := json.Unmarshal(body, &deepseekResp); err != nil {
-		log.Printf("Error parsing DeepSeek response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		ur.logger().Error("Error parsing DeepSeek response", "error", err, "body", truncateForLog(body))
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "", "Invalid response from the upstream")
 		return
 	}
 
@@ -574,9 +500,11 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 			FinishReason string  `json:"finish_reason"`
 		} `json:"choices"`
 		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
+			PromptTokens          int `json:"prompt_tokens"`
+			CompletionTokens      int `json:"completion_tokens"`
+			TotalTokens           int `json:"total_tokens"`
+			PromptCacheHitTokens  int `json:"prompt_cache_hit_tokens,omitempty"`
+			PromptCacheMissTokens int `json:"prompt_cache_miss_tokens,omitempty"`
 		} `json:"usage"`
 	}{
 		ID:      deepseekResp.ID,
@@ -585,6 +513,14 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 		Model:   originalModel,
 		Usage:   deepseekResp.Usage,
 	}
+	ur.Usage = &OAIUsage{
+		PromptTokens:     deepseekResp.Usage.PromptTokens,
+		CompletionTokens: deepseekResp.Usage.CompletionTokens,
+		TotalTokens:      deepseekResp.Usage.TotalTokens,
+	}
+	if hit := deepseekResp.Usage.PromptCacheHitTokens; hit > 0 {
+		ur.Usage.PromptTokensDetails = &OAIPromptTokensDetails{CachedTokens: hit}
+	}
 
 	// Convert choices and ensure tool calls are properly handled
 	openAIResp.Choices = make([]struct {
@@ -609,7 +545,7 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 			for j, tc := range choice.Message.ToolCalls {
 				// Ensure the tool call has the required fields
 				if tc.Function.Name == "" {
-					log.Printf("Warning: Empty function name in tool call %d", j)
+					ur.logger().Warn("Empty function name in tool call", "index", j)
 					continue
 				}
 				// Keep the tool call as is since it's already in the correct format
@@ -621,8 +557,8 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 	// Convert back to JSON
 	modifiedBody, err := json.Marshal(openAIResp)
 	if err != nil {
-		log.Printf("Error creating modified response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		ur.logger().Error("Error creating modified response", "error", err)
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "", "Error serializing the response")
 		return
 	}
 
@@ -631,31 +567,14 @@ func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalM
 	w.Write(modifiedBody)
 }
 
-// isModelNotFoundError 判断响应是否为模型不存在的错误
-func isModelNotFoundError(statusCode int, body []byte) bool {
-	if statusCode == http.StatusNotFound {
-		return true
-	}
-	if statusCode == http.StatusBadRequest || statusCode == http.StatusUnprocessableEntity {
-		lower := strings.ToLower(string(body))
-		return strings.Contains(lower, "model") &&
-			(strings.Contains(lower, "not found") ||
-				strings.Contains(lower, "not exist") ||
-				strings.Contains(lower, "invalid model") ||
-				strings.Contains(lower, "does not exist") ||
-				strings.Contains(lower, "no such model"))
-	}
-	return false
-}
-
-// buildDeepSeekHTTPRequest 根据 DeepSeekRequest 构建 http.Request
-func buildDeepSeekHTTPRequest(origReq *http.Request, body []byte, stream bool, apiKey string) (*http.Request, error) {
-	targetURL := activeConfig.endpoint + origReq.URL.Path
+// buildHTTPRequest builds the upstream http.Request for a translated body
+func (p *deepSeekProvider) buildHTTPRequest(origReq *http.Request, body []byte, stream bool, apiKey string) (*http.Request, error) {
+	targetURL := p.endpoint + origReq.URL.Path
 	if origReq.URL.RawQuery != "" {
 		targetURL += "?" + origReq.URL.RawQuery
 	}
 
-	proxyReq, err := http.NewRequest(origReq.Method, targetURL, bytes.NewReader(body))
+	proxyReq, err := http.NewRequestWithContext(origReq.Context(), origReq.Method, targetURL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -672,63 +591,6 @@ func buildDeepSeekHTTPRequest(origReq *http.Request, body []byte, stream bool, a
 	return proxyReq, nil
 }
 
-// doDeepSeekRequestWithFallback 先用用户指定模型请求，若模型不存在或连接失败则回退到 reasoner 模型
-// 返回响应、实际使用的模型名称、错误
-func doDeepSeekRequestWithFallback(origReq *http.Request, body []byte, dsReq DeepSeekRequest, stream bool, apiKey string) (*http.Response, string, error) {
-	client := &http.Client{Timeout: 5 * time.Minute}
-
-	// --- 第一次尝试：使用用户指定的模型 ---
-	proxyReq, err := buildDeepSeekHTTPRequest(origReq, body, stream, apiKey)
-	if err != nil {
-		log.Printf("Error building proxy request: %v", err)
-		return nil, "", err
-	}
-
-	resp, err := client.Do(proxyReq)
-	if err == nil {
-		// 对于非 4xx 错误直接返回
-		if resp.StatusCode < 400 {
-			return resp, dsReq.Model, nil
-		}
-
-		// 读取响应体以判断是否为模型不存在错误
-		respBody, readErr := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if readErr != nil {
-			return nil, "", readErr
-		}
-
-		if !isModelNotFoundError(resp.StatusCode, respBody) {
-			// 非模型错误，原样返回给调用方
-			resp.Body = io.NopCloser(bytes.NewReader(respBody))
-			return resp, dsReq.Model, nil
-		}
-
-		log.Printf("Model '%s' not found (status %d), falling back to %s", dsReq.Model, resp.StatusCode, deepseekReasonerModel)
-	} else {
-		log.Printf("Connection error for model '%s': %v, falling back to %s", dsReq.Model, err, deepseekReasonerModel)
-	}
-
-	// --- 第二次尝试：回退到 reasoner 模型 ---
-	dsReq.Model = deepseekReasonerModel
-	fallbackBody, marshalErr := json.Marshal(dsReq)
-	if marshalErr != nil {
-		return nil, "", fmt.Errorf("error marshaling fallback request: %v", marshalErr)
-	}
-
-	fallbackReq, err := buildDeepSeekHTTPRequest(origReq, fallbackBody, stream, apiKey)
-	if err != nil {
-		return nil, "", err
-	}
-	log.Printf("Fallback forwarding to: %s (model: %s)", fallbackReq.URL, deepseekReasonerModel)
-
-	resp, err = client.Do(fallbackReq)
-	if err != nil {
-		return nil, "", err
-	}
-	return resp, deepseekReasonerModel, nil
-}
-
 func copyHeaders(dst, src http.Header) {
 	// Headers to skip
 	skipHeaders := map[string]bool{
@@ -747,52 +609,30 @@ func copyHeaders(dst, src http.Header) {
 	}
 }
 
-func handleModelsRequest(w http.ResponseWriter) {
-	// Get the requested model from the query parameters
-	response := ModelsResponse{
-		Object: "list",
-		Data: []Model{
-			{
-				ID:      deepseekChatModel,
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "deepseek",
-			},
-			{
-				ID:      deepseekReasonerModel,
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "deepseek",
-			},
-			{
-				ID:      deepseekCoderModel,
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "deepseek",
-			},
+func (p *deepSeekProvider) Models() []Model {
+	return []Model{
+		{
+			ID:      deepseekChatModel,
+			Object:  "model",
+			Created: staticModelsCreated,
+			OwnedBy: "deepseek",
+		},
+		{
+			ID:      deepseekReasonerModel,
+			Object:  "model",
+			Created: staticModelsCreated,
+			OwnedBy: "deepseek",
+		},
+		{
+			ID:      deepseekCoderModel,
+			Object:  "model",
+			Created: staticModelsCreated,
+			OwnedBy: "deepseek",
 		},
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
 }
 
-func readResponse(resp *http.Response) ([]byte, error) {
-	var reader io.Reader = resp.Body
-
-	switch resp.Header.Get("Content-Encoding") {
-	case "gzip":
-		gzReader, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("error creating gzip reader: %v", err)
-		}
-		defer gzReader.Close()
-		reader = gzReader
-	case "br":
-		reader = brotli.NewReader(resp.Body)
-	case "deflate":
-		reader = flate.NewReader(resp.Body)
-	}
-
-	return io.ReadAll(reader)
+// FetchModels lists the models from the DeepSeek /models endpoint
+func (p *deepSeekProvider) FetchModels(apiKey string) ([]Model, error) {
+	return fetchOpenAIModels(p.endpoint+"/models", apiKey, "deepseek")
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clientLimits caps one client; zero means unlimited
+type clientLimits struct {
+	requestsPerMinute int
+	tokensPerDay      int
+}
+
+// defaultLimits applies to clients without their own limits, set from
+// CLIENT_REQUESTS_PER_MINUTE and CLIENT_TOKENS_PER_DAY in main
+var defaultLimits clientLimits
+
+func defaultLimitsFromEnv() (clientLimits, error) {
+	var limits clientLimits
+	for _, v := range []struct {
+		env string
+		dst *int
+	}{
+		{"CLIENT_REQUESTS_PER_MINUTE", &limits.requestsPerMinute},
+		{"CLIENT_TOKENS_PER_DAY", &limits.tokensPerDay},
+	} {
+		if s := os.Getenv(v.env); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return limits, fmt.Errorf("invalid %s %q", v.env, s)
+			}
+			*v.dst = n
+		}
+	}
+	return limits, nil
+}
+
+// limits returns the client's own limits, falling back to the defaults
+func (c *proxyClient) limits() clientLimits {
+	limits := defaultLimits
+	if c.RequestsPerMinute != nil {
+		limits.requestsPerMinute = *c.RequestsPerMinute
+	}
+	if c.TokensPerDay != nil {
+		limits.tokensPerDay = *c.TokensPerDay
+	}
+	return limits
+}
+
+// limitKey identifies the client whose usage is counted
+func (c *proxyClient) limitKey() string {
+	return firstNonEmpty(c.Token, c.byoKey, c.User)
+}
+
+// rateLimiter counts requests per minute and tokens per UTC day per client
+type rateLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+}
+
+type clientUsage struct {
+	// requests holds the start times of requests within the last minute
+	requests []time.Time
+	day      string
+	tokens   int
+}
+
+var limiter = &rateLimiter{clients: map[string]*clientUsage{}}
+
+// limitStatus is a client's position against its limits, reported in the
+// x-ratelimit-* headers
+type limitStatus struct {
+	limits            clientLimits
+	remainingRequests int
+	resetRequests     time.Duration
+	remainingTokens   int
+	resetTokens       time.Duration
+}
+
+// allow counts a request for c and reports whether it is within the limits.
+// Tokens are only known once the response is done, so the daily quota blocks
+// the requests after the one that exhausted it. A rejected request does not count.
+func (l *rateLimiter) allow(c *proxyClient, now time.Time) (limitStatus, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u := l.usage(c.limitKey(), now)
+	st := limitStatus{limits: c.limits()}
+
+	if len(u.requests) > 0 {
+		st.resetRequests = u.requests[0].Add(time.Minute).Sub(now)
+	}
+	st.resetTokens = nextUTCMidnight(now).Sub(now)
+
+	if max := st.limits.tokensPerDay; max > 0 {
+		st.remainingTokens = max - u.tokens
+		if st.remainingTokens <= 0 {
+			st.remainingTokens = 0
+			return st, fmt.Sprintf("Token quota reached for %s: Limit %d tokens per day, Used %d. Please try again in %s.",
+				c.User, max, u.tokens, st.resetTokens.Round(time.Second))
+		}
+	}
+	if max := st.limits.requestsPerMinute; max > 0 {
+		if len(u.requests) >= max {
+			return st, fmt.Sprintf("Rate limit reached for %s on requests per min (RPM): Limit %d, Used %d. Please try again in %s.",
+				c.User, max, len(u.requests), st.resetRequests.Round(time.Second))
+		}
+		st.remainingRequests = max - len(u.requests) - 1
+	}
+	u.requests = append(u.requests, now)
+	if len(u.requests) == 1 {
+		st.resetRequests = time.Minute
+	}
+	return st, ""
+}
+
+// addTokens charges tokens used by a finished request to c's daily quota
+func (l *rateLimiter) addTokens(c *proxyClient, tokens int, now time.Time) {
+	if tokens <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.usage(c.limitKey(), now).tokens += tokens
+}
+
+// usage returns the counters of a client with expired entries dropped
+func (l *rateLimiter) usage(key string, now time.Time) *clientUsage {
+	u, ok := l.clients[key]
+	if !ok {
+		u = &clientUsage{}
+		l.clients[key] = u
+	}
+	cutoff := now.Add(-time.Minute)
+	kept := u.requests[:0]
+	for _, t := range u.requests {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	u.requests = kept
+	if day := now.UTC().Format("2006-01-02"); u.day != day {
+		u.day, u.tokens = day, 0
+	}
+	return u
+}
+
+func nextUTCMidnight(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// setHeaders adds OpenAI's x-ratelimit-* headers for the limits in force
+func (st limitStatus) setHeaders(h http.Header) {
+	if st.limits.requestsPerMinute > 0 {
+		h.Set("x-ratelimit-limit-requests", strconv.Itoa(st.limits.requestsPerMinute))
+		h.Set("x-ratelimit-remaining-requests", strconv.Itoa(st.remainingRequests))
+		h.Set("x-ratelimit-reset-requests", formatReset(st.resetRequests))
+	}
+	if st.limits.tokensPerDay > 0 {
+		h.Set("x-ratelimit-limit-tokens", strconv.Itoa(st.limits.tokensPerDay))
+		h.Set("x-ratelimit-remaining-tokens", strconv.Itoa(st.remainingTokens))
+		h.Set("x-ratelimit-reset-tokens", formatReset(st.resetTokens))
+	}
+}
+
+// formatReset renders a reset delay the way OpenAI does, e.g. "1s" or "6m0s"
+func formatReset(d time.Duration) string {
+	if d < time.Second {
+		d = time.Second
+	}
+	return d.Round(time.Second).String()
+}
+
+// checkRateLimit enforces c's limits for a chat completion request, answering
+// with an OpenAI-style 429 and returning false when it is over them
+func checkRateLimit(w http.ResponseWriter, r *http.Request, c *proxyClient) bool {
+	return limiter.check(w, r, c, time.Now())
+}
+
+func (l *rateLimiter) check(w http.ResponseWriter, r *http.Request, c *proxyClient, now time.Time) bool {
+	st, reason := l.allow(c, now)
+	st.setHeaders(w.Header())
+	if reason == "" {
+		return true
+	}
+	logFor(r.Context()).Warn("Client rate limited", "user", c.User, "reason", reason)
+	errType, retry := "requests", st.resetRequests
+	if st.limits.tokensPerDay > 0 && st.remainingTokens == 0 {
+		errType, retry = "tokens", st.resetTokens
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Round(time.Second)/time.Second)))
+	writeOpenAIError(w, http.StatusTooManyRequests, errType, "rate_limit_exceeded", reason)
+	return false
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// runReplay implements the replay subcommand: the client request and upstream
+// response of each capture are fed through the current translators offline
+// and the output is diffed against what was captured. With -update the
+// captured translations are replaced, so captures can serve as regression
+// fixtures. It returns the exit status.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	update := fs.Bool("update", false, "Replace the captured translations with the current output")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [-update] <capture dir>...\n\nA directory without meta.json replays every capture in it.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := loadModelConfig(os.Getenv("MODEL_CONFIG")); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid model config: %v\n", err)
+		return 2
+	}
+	promptCaching = promptCachingFromEnv()
+
+	var dirs []string
+	for _, arg := range fs.Args() {
+		found, err := captureDirs(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", arg, err)
+			return 2
+		}
+		dirs = append(dirs, found...)
+	}
+
+	failed := 0
+	for _, dir := range dirs {
+		diff, err := replayCapture(dir, *update)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("FAIL %s: %v\n", dir, err)
+		case diff == "":
+			fmt.Printf("ok   %s\n", dir)
+		case *update:
+			fmt.Printf("upd  %s\n%s", dir, diff)
+		default:
+			failed++
+			fmt.Printf("DIFF %s\n%s", dir, diff)
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// captureDirs returns dir if it is a capture, and otherwise the captures in
+// it, oldest first
+func captureDirs(dir string) ([]string, error) {
+	if _, err := os.Stat(filepath.Join(dir, captureMetaFile)); err == nil {
+		return []string{dir}, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(dir, e.Name(), captureMetaFile)); e.IsDir() && err == nil {
+			dirs = append(dirs, filepath.Join(dir, e.Name()))
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no captures found")
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// replayCapture translates one capture again and returns the differences
+// from the captured translations, empty when there are none
+func replayCapture(dir string, update bool) (string, error) {
+	var meta captureMeta
+	data, err := os.ReadFile(filepath.Join(dir, captureMetaFile))
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return "", fmt.Errorf("invalid %s: %v", captureMetaFile, err)
+	}
+	if meta.Provider == "" {
+		return "", fmt.Errorf("the request never reached an upstream, nothing to replay")
+	}
+	spec, ok := providerSpecs[meta.Provider]
+	if !ok {
+		return "", fmt.Errorf("unknown provider %q", meta.Provider)
+	}
+	p := spec.newProvider(spec.defaultEndpoint, newKeyPool(meta.Provider, keyStrategy, nil))
+
+	// Client request → upstream request, as in forwardModel
+	body, err := os.ReadFile(filepath.Join(dir, captureRequestFile))
+	if err != nil {
+		return "", err
+	}
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal(body, &reqMap); err != nil {
+		return "", fmt.Errorf("invalid %s: %v", captureRequestFile, err)
+	}
+	body, _, aliased, err := requestBodyFor(body, reqMap, meta.Model)
+	if err != nil {
+		return "", err
+	}
+	ur, err := p.TranslateRequest(body)
+	if err != nil {
+		return "", fmt.Errorf("translating request: %v", err)
+	}
+	if aliased {
+		ur.Model = meta.Model
+	}
+	replayed := map[string][]byte{captureUpstreamRequestFile: ur.Body}
+
+	// Upstream response → client response
+	ext := captureExt(meta.Stream && meta.UpstreamStatus < 400)
+	upstream, err := os.ReadFile(filepath.Join(dir, captureUpstreamResponse+ext))
+	if err != nil {
+		return "", err
+	}
+	resp := &http.Response{
+		StatusCode: meta.UpstreamStatus,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(upstream)),
+	}
+	rec := httptest.NewRecorder()
+	switch {
+	case meta.UpstreamStatus >= 400:
+		writeUpstreamError(rec, resp, upstream)
+	case ur.Stream:
+		resp.Header.Set("Content-Type", "text/event-stream")
+		p.TranslateStream(rec, resp, ur)
+	default:
+		resp.Header.Set("Content-Type", "application/json")
+		p.TranslateResponse(rec, resp, ur)
+	}
+	replayed[captureResponse+ext] = rec.Body.Bytes()
+
+	var diff strings.Builder
+	for _, file := range []string{captureUpstreamRequestFile, captureResponse + ext} {
+		got := replayed[file]
+		want, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		got = []byte(redact(string(got)))
+		d := diffLines(file, normalizeCapture(want), normalizeCapture(got))
+		if d == "" {
+			continue
+		}
+		diff.WriteString(d)
+		if update {
+			if err := os.WriteFile(filepath.Join(dir, file), got, 0600); err != nil {
+				return "", err
+			}
+		}
+	}
+	return diff.String(), nil
+}
+
+var createdField = regexp.MustCompile(`"created":\s*\d+`)
+
+// normalizeCapture prepares a capture file for diffing: JSON bodies are
+// indented with sorted keys, and creation times and heartbeats, which change
+// on every run, are removed
+func normalizeCapture(data []byte) []string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err == nil {
+		if indented, err := json.MarshalIndent(v, "", "  "); err == nil {
+			data = indented
+		}
+	}
+	s := createdField.ReplaceAllString(string(data), `"created":0`)
+	s = strings.ReplaceAll(s, heartbeatComment, "")
+	return strings.Split(strings.TrimRight(s, "\n"), "\n")
+}
+
+// maxDiffLines caps the changed lines shown per file
+const maxDiffLines = 40
+
+// diffLines returns the lines removed from and added to want to get got,
+// found with a longest common subsequence, or "" when they are equal
+func diffLines(name string, want, got []string) string {
+	if strings.Join(want, "\n") == strings.Join(got, "\n") {
+		return ""
+	}
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s (captured)\n+++ %s (replayed)\n", name, name)
+
+	// Trim the common prefix and suffix so the table stays small
+	start := 0
+	for start < len(want) && start < len(got) && want[start] == got[start] {
+		start++
+	}
+	endW, endG := len(want), len(got)
+	for endW > start && endG > start && want[endW-1] == got[endG-1] {
+		endW--
+		endG--
+	}
+	a, b := want[start:endW], got[start:endG]
+
+	var lines []string
+	if len(a)*len(b) > 4_000_000 {
+		for _, l := range a {
+			lines = append(lines, "-"+l)
+		}
+		for _, l := range b {
+			lines = append(lines, "+"+l)
+		}
+	} else {
+		// lcs[i][j] is the LCS length of a[i:] and b[j:]
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(a) || j < len(b) {
+			switch {
+			case i < len(a) && j < len(b) && a[i] == b[j]:
+				i++
+				j++
+			case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+				lines = append(lines, "-"+a[i])
+				i++
+			default:
+				lines = append(lines, "+"+b[j])
+				j++
+			}
+		}
+	}
+
+	fmt.Fprintf(&out, "@@ from line %d @@\n", start+1)
+	for n, l := range lines {
+		if n == maxDiffLines {
+			fmt.Fprintf(&out, "... %d more changed lines\n", len(lines)-n)
+			break
+		}
+		out.WriteString(l + "\n")
+	}
+	return out.String()
+}
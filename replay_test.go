@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayCapture(t *testing.T) {
+	upstream := newMockUpstream(t, anthropicResponse("Hello!"))
+	useProvider(t, "o2a", upstream.URL)
+	store := useCaptures(t, 10)
+	if rec := postChat(t, chatRequest("claude-sonnet-4.5", false)); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+	}
+	dir := captureDir(t, store)
+
+	diff, err := replayCapture(dir, false)
+	if err != nil {
+		t.Fatalf("replayCapture: %v", err)
+	}
+	if diff != "" {
+		t.Errorf("replaying an unchanged capture differs:\n%s", diff)
+	}
+
+	// A captured response the translator no longer produces
+	response := filepath.Join(dir, "response.json")
+	data, _ := os.ReadFile(response)
+	if err := os.WriteFile(response, []byte(strings.Replace(string(data), "Hello!", "Goodbye!", 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = replayCapture(dir, false)
+	if err != nil {
+		t.Fatalf("replayCapture: %v", err)
+	}
+	for _, want := range []string{"--- response.json (captured)", `-        "content": "Goodbye!",`, `+        "content": "Hello!",`} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff does not contain %q:\n%s", want, diff)
+		}
+	}
+	if strings.Contains(diff, "upstream_request.json") {
+		t.Errorf("diff reports the unchanged upstream request:\n%s", diff)
+	}
+
+	// -update takes the replayed output as the new fixture
+	if _, err := replayCapture(dir, true); err != nil {
+		t.Fatalf("replayCapture -update: %v", err)
+	}
+	if diff, _ := replayCapture(dir, false); diff != "" {
+		t.Errorf("capture still differs after -update:\n%s", diff)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name      string
+		want, got []string
+		diff      string
+	}{
+		{name: "equal", want: []string{"a", "b"}, got: []string{"a", "b"}},
+		{
+			name: "changed line",
+			want: []string{"a", "b", "c"},
+			got:  []string{"a", "x", "c"},
+			diff: "--- f (captured)\n+++ f (replayed)\n@@ from line 2 @@\n-b\n+x\n",
+		},
+		{
+			name: "inserted line",
+			want: []string{"a", "c"},
+			got:  []string{"a", "b", "c"},
+			diff: "--- f (captured)\n+++ f (replayed)\n@@ from line 2 @@\n+b\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := diffLines("f", tc.want, tc.got); got != tc.diff {
+				t.Errorf("diffLines = %q, want %q", got, tc.diff)
+			}
+		})
+	}
+}
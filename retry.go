@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxRetries     = 2
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	// maxRetryDelay caps the backoff; an upstream asking to wait longer than
+	// this gets its error passed to the client instead
+	maxRetryDelay = 30 * time.Second
+)
+
+// retryPolicy controls how failed upstream requests are retried
+type retryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+}
+
+// upstreamRetry is set up in main once the environment is loaded
+var upstreamRetry = retryPolicy{maxRetries: defaultMaxRetries, baseDelay: defaultRetryBaseDelay}
+
+// retryPolicyFromEnv reads UPSTREAM_MAX_RETRIES and UPSTREAM_RETRY_BASE_DELAY
+func retryPolicyFromEnv() retryPolicy {
+	policy := retryPolicy{maxRetries: defaultMaxRetries, baseDelay: defaultRetryBaseDelay}
+	if v := os.Getenv("UPSTREAM_MAX_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			policy.maxRetries = n
+		} else {
+			slog.Warn("Invalid UPSTREAM_MAX_RETRIES, using the default", "value", v, "default", defaultMaxRetries)
+		}
+	}
+	if v := os.Getenv("UPSTREAM_RETRY_BASE_DELAY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			policy.baseDelay = d
+		} else {
+			slog.Warn("Invalid UPSTREAM_RETRY_BASE_DELAY, using the default", "value", v, "default", defaultRetryBaseDelay.String())
+		}
+	}
+	return policy
+}
+
+// sendWithRetry forwards ur through p, retrying connection errors, rate limits
+// and overloaded or failing upstreams with jittered exponential backoff. It
+// runs before anything is written to the client, so a retried stream never
+// reaches Cursor twice. The last response or error is returned as is.
+//
+// Requests are sent with clientKey when the client brought its own key, and
+// otherwise with a key from the provider's pool; a pooled key that is rate
+// limited or rejected is swapped for another one without waiting.
+func sendWithRetry(r *http.Request, p Provider, ur *UpstreamRequest, clientKey string) (*http.Response, error) {
+	logger := ur.logger()
+	for attempt := 0; ; attempt++ {
+		ur.Retries = attempt
+		apiKey := clientKey
+		var key *poolKey
+		if apiKey == "" {
+			if key = p.Keys().pick(); key == nil {
+				return nil, fmt.Errorf("no usable API key for %s, all keys are quarantined", p.Name())
+			}
+			apiKey = key.secret
+		}
+
+		ur.SentAt = time.Now()
+		resp, err := p.Send(r, ur, apiKey)
+		upstreamResponsesTotal.add(1, p.Name(), statusLabel(resp, err))
+		if key != nil {
+			p.Keys().report(key, resp, err)
+		}
+		if attempt >= upstreamRetry.maxRetries || r.Context().Err() != nil {
+			return resp, err
+		}
+
+		retryStatus := statusLabel(resp, err)
+		var delay time.Duration
+		switch {
+		case err != nil:
+			delay = upstreamRetry.backoff(attempt)
+			logger.Warn("Upstream request failed, retrying", "error", err, "delay_ms", delay.Milliseconds(), "retry", attempt+1, "max_retries", upstreamRetry.maxRetries)
+		case key != nil && isKeyFailure(resp.StatusCode) && p.Keys().hasUsable(key):
+			resp.Body.Close()
+			logger.Warn("Upstream rejected key, retrying with another key", "status", resp.StatusCode, "retry", attempt+1, "max_retries", upstreamRetry.maxRetries)
+			retriesTotal.add(1, p.Name(), retryStatus)
+			continue
+		case isRetryableStatus(resp.StatusCode):
+			var ok bool
+			if delay, ok = retryAfter(resp.Header); !ok {
+				delay = upstreamRetry.backoff(attempt)
+			}
+			if delay > maxRetryDelay {
+				logger.Warn("Upstream retry-after too long, giving up", "status", resp.StatusCode, "retry_after_ms", delay.Milliseconds())
+				return resp, nil
+			}
+			resp.Body.Close()
+			logger.Warn("Upstream returned retryable status, retrying", "status", resp.StatusCode, "delay_ms", delay.Milliseconds(), "retry", attempt+1, "max_retries", upstreamRetry.maxRetries)
+		default:
+			return resp, nil
+		}
+		retriesTotal.add(1, p.Name(), retryStatus)
+
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+// isKeyFailure reports whether a status is about the key rather than the request
+func isKeyFailure(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// isRetryableStatus reports whether a status is worth retrying: rate limits,
+// server errors and Anthropic's 529 overloaded_error
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout, 529:
+		return true
+	}
+	return false
+}
+
+// backoff returns the jittered delay before retry number attempt+1
+func (rp retryPolicy) backoff(attempt int) time.Duration {
+	d := rp.baseDelay << uint(attempt)
+	if d <= 0 || d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	// Pick a random delay in [d/2, d) so concurrent clients spread out
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter returns the wait requested by the upstream, from retry-after or,
+// for Anthropic, the latest anthropic-ratelimit-*-reset of an exhausted limit
+func retryAfter(h http.Header) (time.Duration, bool) {
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs >= 0 {
+			return time.Duration(secs * float64(time.Second)), true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return nonNegative(time.Until(t)), true
+		}
+	}
+
+	var latest time.Time
+	for key, values := range h {
+		lower := strings.ToLower(key)
+		if !strings.HasPrefix(lower, "anthropic-ratelimit-") || !strings.HasSuffix(lower, "-reset") || len(values) == 0 {
+			continue
+		}
+		remaining := h.Get(strings.TrimSuffix(key, "-Reset") + "-Remaining")
+		if remaining != "0" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, values[0]); err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	if latest.IsZero() {
+		return 0, false
+	}
+	return nonNegative(time.Until(latest)), true
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
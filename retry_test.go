@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		header map[string]string
+		// want is the expected wait, slack allows for clock and date rounding
+		want, slack time.Duration
+		wantOK      bool
+	}{
+		{name: "seconds", header: map[string]string{"Retry-After": "7"}, want: 7 * time.Second, wantOK: true},
+		{name: "fractional seconds", header: map[string]string{"Retry-After": "0.5"}, want: 500 * time.Millisecond, wantOK: true},
+		{name: "HTTP date", header: map[string]string{"Retry-After": now.Add(20 * time.Second).UTC().Format(http.TimeFormat)}, want: 20 * time.Second, slack: 2 * time.Second, wantOK: true},
+		{name: "HTTP date in the past", header: map[string]string{"Retry-After": now.Add(-time.Minute).UTC().Format(http.TimeFormat)}, want: 0, wantOK: true},
+		{
+			name: "exhausted anthropic limit",
+			header: map[string]string{
+				"anthropic-ratelimit-requests-remaining": "0",
+				"anthropic-ratelimit-requests-reset":     now.Add(10 * time.Second).UTC().Format(time.RFC3339),
+				"anthropic-ratelimit-tokens-remaining":   "5000",
+				"anthropic-ratelimit-tokens-reset":       now.Add(50 * time.Second).UTC().Format(time.RFC3339),
+			},
+			want: 10 * time.Second, slack: 2 * time.Second, wantOK: true,
+		},
+		{
+			name: "latest of several exhausted limits",
+			header: map[string]string{
+				"anthropic-ratelimit-requests-remaining":     "0",
+				"anthropic-ratelimit-requests-reset":         now.Add(10 * time.Second).UTC().Format(time.RFC3339),
+				"anthropic-ratelimit-input-tokens-remaining": "0",
+				"anthropic-ratelimit-input-tokens-reset":     now.Add(25 * time.Second).UTC().Format(time.RFC3339),
+			},
+			want: 25 * time.Second, slack: 2 * time.Second, wantOK: true,
+		},
+		{
+			name: "anthropic limit not exhausted",
+			header: map[string]string{
+				"anthropic-ratelimit-requests-remaining": "3",
+				"anthropic-ratelimit-requests-reset":     now.Add(10 * time.Second).UTC().Format(time.RFC3339),
+			},
+		},
+		{name: "invalid", header: map[string]string{"Retry-After": "soon"}},
+		{name: "none"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tc.header {
+				h.Set(k, v)
+			}
+			got, ok := retryAfter(h)
+			if ok != tc.wantOK {
+				t.Fatalf("ok = %t, want %t", ok, tc.wantOK)
+			}
+			if diff := got - tc.want; diff < -tc.slack || diff > tc.slack {
+				t.Errorf("retryAfter = %s, want %s ± %s", got, tc.want, tc.slack)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	rp := retryPolicy{maxRetries: 5, baseDelay: 100 * time.Millisecond}
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		for i := 0; i < 20; i++ {
+			if d := rp.backoff(attempt); d < want/2 || d > want {
+				t.Errorf("backoff(%d) = %s, want within [%s, %s]", attempt, d, want/2, want)
+			}
+		}
+	}
+	if d := rp.backoff(20); d < maxRetryDelay/2 || d > maxRetryDelay {
+		t.Errorf("backoff(20) = %s, want it capped at %s", d, maxRetryDelay)
+	}
+}
+
+var (
+	overloadedReply = upstreamReply{status: 529, body: `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`}
+	apiErrorReply   = upstreamReply{status: http.StatusInternalServerError, body: `{"type":"error","error":{"type":"api_error","message":"Internal server error"}}`}
+)
+
+func TestSendWithRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		replies    []upstreamReply
+		wantStatus int
+		// wantRetryCounts are the x-stainless-retry-count headers upstream saw
+		wantRetryCounts []string
+	}{
+		{
+			name:            "retryable statuses until success",
+			replies:         []upstreamReply{apiErrorReply, overloadedReply, anthropicResponse("Hello!")},
+			wantStatus:      http.StatusOK,
+			wantRetryCounts: []string{"0", "1", "2"},
+		},
+		{
+			name:            "retries exhausted",
+			replies:         []upstreamReply{overloadedReply, overloadedReply, overloadedReply},
+			wantStatus:      http.StatusServiceUnavailable,
+			wantRetryCounts: []string{"0", "1", "2"},
+		},
+		{
+			name:            "bad request is not retried",
+			replies:         []upstreamReply{{status: http.StatusBadRequest, body: `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: too large"}}`}},
+			wantStatus:      http.StatusBadRequest,
+			wantRetryCounts: []string{"0"},
+		},
+		{
+			name:            "short retry-after is waited out",
+			replies:         []upstreamReply{{status: http.StatusTooManyRequests, header: map[string]string{"retry-after": "0"}, body: anthropicRateLimit.body}, anthropicResponse("Hello!")},
+			wantStatus:      http.StatusOK,
+			wantRetryCounts: []string{"0", "1"},
+		},
+		{
+			name:            "retry-after above the cap gives up",
+			replies:         []upstreamReply{{status: http.StatusTooManyRequests, header: map[string]string{"retry-after": "120"}, body: anthropicRateLimit.body}},
+			wantStatus:      http.StatusTooManyRequests,
+			wantRetryCounts: []string{"0"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newMockUpstream(t, tc.replies...)
+			useProvider(t, "o2a-max", upstream.URL)
+			upstreamRetry = retryPolicy{maxRetries: 2, baseDelay: time.Millisecond}
+
+			start := time.Now()
+			rec := postChat(t, chatRequest("claude-sonnet-4.5", false))
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d; body: %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("took %s, want no long waits", elapsed)
+			}
+			var counts []string
+			for _, req := range upstream.received() {
+				counts = append(counts, req.header.Get("x-stainless-retry-count"))
+			}
+			if strings.Join(counts, ",") != strings.Join(tc.wantRetryCounts, ",") {
+				t.Errorf("x-stainless-retry-count = %v, want %v", counts, tc.wantRetryCounts)
+			}
+		})
+	}
+}
+
+func TestSendWithRetryRotatesRateLimitedKey(t *testing.T) {
+	upstream := newMockUpstream(t, anthropicRateLimit, anthropicResponse("Hello!"))
+	pool := newKeyPool("o2a", keyStrategyRoundRobin, []string{"sk-test-key-one", "sk-test-key-two"})
+	useRoutes(t, route{pattern: "*", provider: providerSpecs["o2a"].newProvider(upstream.URL, pool)})
+	upstreamRetry = retryPolicy{maxRetries: 2, baseDelay: time.Millisecond}
+
+	start := time.Now()
+	rec := postChat(t, chatRequest("claude-sonnet-4.5", false))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+	}
+	// The other key is used at once instead of waiting out retry-after
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s, want the key swapped without waiting", elapsed)
+	}
+	reqs := upstream.received()
+	if len(reqs) != 2 || reqs[0].header.Get("x-api-key") != "sk-test-key-one" || reqs[1].header.Get("x-api-key") != "sk-test-key-two" {
+		t.Errorf("upstream requests = %+v, want one per key", reqs)
+	}
+}
+
+func TestSendWithRetryStopsWhenCancelled(t *testing.T) {
+	upstream := newMockUpstream(t, upstreamReply{status: http.StatusServiceUnavailable, header: map[string]string{"retry-after": "20"}, body: overloadedReply.body})
+	p := testProvider(t, "o2a", upstream.URL)
+	oldRetry := upstreamRetry
+	t.Cleanup(func() { upstreamRetry = oldRetry })
+	upstreamRetry = retryPolicy{maxRetries: 2, baseDelay: time.Millisecond}
+
+	ur, err := p.TranslateRequest([]byte(chatRequest("claude-sonnet-4.5", false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(ctx)
+
+	start := time.Now()
+	resp, err := sendWithRetry(r, p, ur, "")
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want the context error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s, want the retry wait abandoned", elapsed)
+	}
+	if got := len(upstream.received()); got != 1 {
+		t.Errorf("upstream got %d requests, want 1", got)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// defaultRoutes is used when neither MODEL_ROUTES nor a single provider is configured
+const defaultRoutes = "deepseek-*=deepseek,claude-*=o2a,*=poe"
+
+// route sends models matching pattern to provider. Patterns are globs where
+// '*' matches any run of characters (including '/') and '?' a single one, so
+// "claude-*" is a prefix rule and a pattern without wildcards is exact.
+type route struct {
+	pattern  string
+	provider Provider
+}
+
+// routes is checked in order; the first matching pattern wins
+var routes []route
+
+var (
+	providersMu sync.Mutex
+	// providers holds one shared instance per provider name
+	providers = map[string]Provider{}
+)
+
+// getProvider returns the shared instance of a registered provider, creating
+// it from its env vars on first use
+func getProvider(name string) (Provider, error) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if p, ok := providers[name]; ok {
+		return p, nil
+	}
+	p, err := buildProvider(name, "", "")
+	if err != nil {
+		return nil, err
+	}
+	providers[name] = p
+	return p, nil
+}
+
+// parseRoutes parses "pattern=provider,pattern=provider,..." into rules
+func parseRoutes(spec string) ([]route, error) {
+	var parsed []route
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		pattern, name, ok := strings.Cut(rule, "=")
+		pattern, name = strings.TrimSpace(pattern), strings.TrimSpace(name)
+		if !ok || pattern == "" || name == "" {
+			return nil, fmt.Errorf("invalid route %q, expected pattern=provider", rule)
+		}
+		p, err := getProvider(name)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, route{pattern: pattern, provider: p})
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("no routes configured")
+	}
+	return parsed, nil
+}
+
+// routeModel returns the provider serving model, or nil when no rule matches
+func routeModel(model string) Provider {
+	for _, rt := range routes {
+		if matchGlob(rt.pattern, model) {
+			return rt.provider
+		}
+	}
+	return nil
+}
+
+// providerForModel resolves the provider for a client model name: an alias
+// pinned to a provider wins, otherwise the routing table decides
+func providerForModel(model string) Provider {
+	if alias, ok := lookupAlias(model); ok && alias.Provider != "" {
+		p, _ := getProvider(alias.Provider)
+		return p
+	}
+	return routeModel(model)
+}
+
+// routedProviders returns every provider referenced by the routing table, in rule order
+func routedProviders() []Provider {
+	var out []Provider
+	seen := map[Provider]bool{}
+	for _, rt := range routes {
+		if !seen[rt.provider] {
+			seen[rt.provider] = true
+			out = append(out, rt.provider)
+		}
+	}
+	return out
+}
+
+// matchGlob reports whether s matches pattern, where '*' matches any sequence
+// of characters and '?' matches exactly one
+func matchGlob(pattern, s string) bool {
+	px, sx := 0, 0
+	// position to resume from after the last '*'
+	starPx, starSx := -1, 0
+	for sx < len(s) {
+		switch {
+		case px < len(pattern) && (pattern[px] == '?' || pattern[px] == s[sx]):
+			px++
+			sx++
+		case px < len(pattern) && pattern[px] == '*':
+			starPx, starSx = px, sx
+			px++
+		case starPx >= 0:
+			starSx++
+			px, sx = starPx+1, starSx
+		default:
+			return false
+		}
+	}
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"claude-*", "claude-sonnet-4.5", true},
+		{"claude-*", "claude-", true},
+		{"claude-*", "anthropic/claude-sonnet", false},
+		{"*-reasoner", "deepseek-reasoner", true},
+		{"*-reasoner", "deepseek-reasoner-v2", false},
+		{"*sonnet*", "claude-sonnet-4.5", true},
+		{"*sonnet*", "claude-opus-4.6", false},
+		{"anthropic/*", "anthropic/claude-3/beta", true},
+		{"gpt-?o", "gpt-4o", true},
+		{"gpt-?o", "gpt-40o", false},
+		{"claude-*-4.?", "claude-opus-4.6", true},
+		{"deepseek-chat", "deepseek-chat", true},
+		{"deepseek-chat", "deepseek-chat-v2", false},
+		{"*", "anything/at all", true},
+		{"*", "", true},
+		{"", "", true},
+		{"", "x", false},
+	}
+	for _, tc := range tests {
+		if got := matchGlob(tc.pattern, tc.s); got != tc.want {
+			t.Errorf("matchGlob(%q, %q) = %t, want %t", tc.pattern, tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		// want lists the rules as pattern=provider
+		want    []string
+		wantErr string
+	}{
+		{name: "default", spec: defaultRoutes, want: []string{"deepseek-*=deepseek", "claude-*=o2a", "*=poe"}},
+		{name: "spaces and empty rules", spec: " claude-* = o2a-max ,, *=poe ", want: []string{"claude-*=o2a-max", "*=poe"}},
+		{name: "missing =", spec: "claude-*=o2a,deepseek-chat", wantErr: `invalid route "deepseek-chat"`},
+		{name: "missing provider", spec: "claude-*=", wantErr: `invalid route "claude-*="`},
+		{name: "missing pattern", spec: "=poe", wantErr: `invalid route "=poe"`},
+		{name: "unknown provider", spec: "gpt-*=openai", wantErr: `unknown provider "openai"`},
+		{name: "empty", spec: " , ", wantErr: "no routes configured"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			parsed, err := parseRoutes(tc.spec)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRoutes: %v", err)
+			}
+			var got []string
+			for _, rt := range parsed {
+				got = append(got, rt.pattern+"="+rt.provider.Name())
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("routes = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRouteModel(t *testing.T) {
+	parsed, err := parseRoutes("deepseek-reasoner=poe," + defaultRoutes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRoutes := routes
+	t.Cleanup(func() { routes = oldRoutes })
+	routes = parsed
+
+	tests := []struct{ model, want string }{
+		// The exact rule comes first, so it wins over deepseek-*
+		{"deepseek-reasoner", "poe"},
+		{"deepseek-chat", "deepseek"},
+		{"claude-sonnet-4.5", "o2a"},
+		{"gpt-4o", "poe"},
+		{"", "poe"},
+	}
+	for _, tc := range tests {
+		p := routeModel(tc.model)
+		if p == nil || p.Name() != tc.want {
+			t.Errorf("routeModel(%q) = %v, want %s", tc.model, p, tc.want)
+		}
+	}
+
+	routes = parsed[:3]
+	if p := routeModel("gpt-4o"); p != nil {
+		t.Errorf("routeModel(gpt-4o) = %s without a catch-all, want nil", p.Name())
+	}
+}
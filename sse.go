@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// defaultHeartbeatInterval stays well below the idle timeouts of ngrok and
+// the usual reverse proxies, which drop a connection silent for a minute
+const defaultHeartbeatInterval = 15 * time.Second
+
+// heartbeatComment is an SSE comment; clients ignore it, proxies see traffic
+const heartbeatComment = ": ping\n\n"
+
+// heartbeatInterval is set up in main once the environment is loaded; 0
+// turns heartbeats off
+var heartbeatInterval = defaultHeartbeatInterval
+
+// heartbeatIntervalFromEnv reads SSE_HEARTBEAT_INTERVAL
+func heartbeatIntervalFromEnv() time.Duration {
+	v := os.Getenv("SSE_HEARTBEAT_INTERVAL")
+	if v == "" {
+		return defaultHeartbeatInterval
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return d
+	}
+	slog.Warn("Invalid SSE_HEARTBEAT_INTERVAL, using the default", "value", v, "default", defaultHeartbeatInterval.String())
+	return defaultHeartbeatInterval
+}
+
+// sseReader reads an upstream SSE stream line by line for a streaming
+// converter. While it waits for the next line, a heartbeat comment is sent to
+// the client every heartbeatInterval, so a long thinking or tool-argument
+// pause doesn't get the connection dropped by a proxy in front of us.
+type sseReader struct {
+	w       io.Writer
+	flusher http.Flusher
+	lines   chan sseLine
+	done    chan struct{}
+}
+
+type sseLine struct {
+	data []byte
+	err  error
+}
+
+// newSSEReader starts reading body; the caller must Close the reader when it
+// stops reading before the end of the stream
+func newSSEReader(body io.Reader, w http.ResponseWriter) *sseReader {
+	s := &sseReader{w: w, lines: make(chan sseLine), done: make(chan struct{})}
+	s.flusher, _ = w.(http.Flusher)
+	go func() {
+		reader := bufio.NewReader(body)
+		for {
+			line, err := reader.ReadBytes('\n')
+			select {
+			case s.lines <- sseLine{line, err}:
+			case <-s.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// ReadLine returns the next line including its newline, like
+// bufio.Reader.ReadBytes, sending heartbeats while it waits
+func (s *sseReader) ReadLine() ([]byte, error) {
+	if heartbeatInterval <= 0 {
+		l := <-s.lines
+		return l.data, l.err
+	}
+	timer := time.NewTimer(heartbeatInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case l := <-s.lines:
+			return l.data, l.err
+		case <-timer.C:
+			s.Heartbeat()
+			timer.Reset(heartbeatInterval)
+		}
+	}
+}
+
+// Heartbeat sends a heartbeat comment to the client right away
+func (s *sseReader) Heartbeat() {
+	io.WriteString(s.w, heartbeatComment)
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// Close stops the reading goroutine once the converter is done
+func (s *sseReader) Close() {
+	close(s.done)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Upstream transport defaults. There is no total timeout by default: an
+// agentic turn can stream for many minutes, and the idle timeout catches an
+// upstream that hangs. Non-streaming requests get their response headers only
+// once the whole answer is generated, hence the long header timeout.
+const (
+	defaultDialTimeout           = 10 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 10 * time.Minute
+	defaultUpstreamIdleTimeout   = 5 * time.Minute
+	// maxIdleConnsPerHost keeps enough warm connections for concurrent
+	// requests to one upstream; Go's default is 2
+	maxIdleConnsPerHost = 32
+	idleConnTimeout     = 90 * time.Second
+)
+
+// transportConfig is the setup of the HTTP client used for every upstream
+// request; a zero timeout is no timeout
+type transportConfig struct {
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	// idleTimeout is the longest wait for the next chunk of a response body
+	idleTimeout time.Duration
+	// totalTimeout caps a whole request including reading the response
+	totalTimeout time.Duration
+	// proxy is the outbound proxy; nil uses HTTPS_PROXY, HTTP_PROXY and
+	// NO_PROXY from the environment
+	proxy *url.URL
+	// tlsConfig holds the extra CA certificates and the client certificate
+	tlsConfig *tls.Config
+}
+
+func defaultTransportConfig() transportConfig {
+	return transportConfig{
+		dialTimeout:           defaultDialTimeout,
+		tlsHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		responseHeaderTimeout: defaultResponseHeaderTimeout,
+		idleTimeout:           defaultUpstreamIdleTimeout,
+	}
+}
+
+// upstreamClient sends every upstream request, sharing one connection pool;
+// it is set up in main once the environment is loaded
+var upstreamClient = newUpstreamClient(defaultTransportConfig())
+
+// transportConfigFromEnv reads the UPSTREAM_* timeouts, UPSTREAM_PROXY,
+// UPSTREAM_CA_FILE, UPSTREAM_CLIENT_CERT and UPSTREAM_CLIENT_KEY
+func transportConfigFromEnv() (transportConfig, error) {
+	cfg := defaultTransportConfig()
+	for _, d := range []struct {
+		env    string
+		target *time.Duration
+	}{
+		{"UPSTREAM_DIAL_TIMEOUT", &cfg.dialTimeout},
+		{"UPSTREAM_TLS_HANDSHAKE_TIMEOUT", &cfg.tlsHandshakeTimeout},
+		{"UPSTREAM_RESPONSE_HEADER_TIMEOUT", &cfg.responseHeaderTimeout},
+		{"UPSTREAM_IDLE_TIMEOUT", &cfg.idleTimeout},
+		{"UPSTREAM_TIMEOUT", &cfg.totalTimeout},
+	} {
+		v := os.Getenv(d.env)
+		if v == "" {
+			continue
+		}
+		if t, err := time.ParseDuration(v); err == nil && t >= 0 {
+			*d.target = t
+		} else {
+			slog.Warn("Invalid "+d.env+", using the default", "value", v, "default", d.target.String())
+		}
+	}
+
+	if v := os.Getenv("UPSTREAM_PROXY"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil {
+			return cfg, fmt.Errorf("UPSTREAM_PROXY: %v", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return cfg, fmt.Errorf("UPSTREAM_PROXY: unsupported scheme %q, want http, https, socks5 or socks5h", u.Scheme)
+		}
+		if password, ok := u.User.Password(); ok {
+			registerSecret(password)
+		}
+		cfg.proxy = u
+	}
+
+	tlsConfig, err := upstreamTLSConfig(os.Getenv("UPSTREAM_CA_FILE"), os.Getenv("UPSTREAM_CLIENT_CERT"), os.Getenv("UPSTREAM_CLIENT_KEY"))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.tlsConfig = tlsConfig
+	return cfg, nil
+}
+
+// upstreamTLSConfig trusts the certificates in caFile on top of the system
+// ones and presents the client certificate for mTLS relays. It returns nil
+// when none of them is set.
+func upstreamTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("UPSTREAM_CA_FILE: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("UPSTREAM_CA_FILE: no PEM certificates in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("UPSTREAM_CLIENT_CERT and UPSTREAM_CLIENT_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newUpstreamClient builds the shared upstream client from cfg
+func newUpstreamClient(cfg transportConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.dialTimeout, KeepAlive: 30 * time.Second}
+	proxy := http.ProxyFromEnvironment
+	if cfg.proxy != nil {
+		proxy = http.ProxyURL(cfg.proxy)
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       cfg.tlsConfig,
+		TLSHandshakeTimeout:   cfg.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.responseHeaderTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	var rt http.RoundTripper = transport
+	if cfg.idleTimeout > 0 {
+		rt = &idleTimeoutTransport{base: transport, idle: cfg.idleTimeout}
+	}
+	return &http.Client{Transport: rt, Timeout: cfg.totalTimeout}
+}
+
+// errUpstreamIdle is returned by a response body that went silent for longer
+// than the idle timeout
+var errUpstreamIdle = errors.New("no data from the upstream within UPSTREAM_IDLE_TIMEOUT")
+
+// idleTimeoutTransport aborts a response whose body sends nothing for idle.
+// Heartbeats and Anthropic pings count as data, so only a hung upstream is
+// cut off.
+type idleTimeoutTransport struct {
+	base http.RoundTripper
+	idle time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	// clientGone looks at the context of resp.Request, which must not see
+	// an idle timeout as the client going away
+	resp.Request = req
+	body := &idleTimeoutBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, idle: t.idle}
+	body.timer = time.AfterFunc(t.idle, func() { cancel(errUpstreamIdle) })
+	resp.Body = body
+	return resp, nil
+}
+
+type idleTimeoutBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	idle   time.Duration
+	timer  *time.Timer
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.idle)
+	}
+	if err != nil && context.Cause(b.ctx) == errUpstreamIdle {
+		err = errUpstreamIdle
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel(nil)
+	return b.ReadCloser.Close()
+}
+
+// logTransportConfig writes the non-default parts of the upstream setup
+func logTransportConfig(cfg transportConfig) {
+	if cfg.proxy != nil {
+		slog.Info("Using upstream proxy", "proxy", cfg.proxy.Redacted())
+	}
+	if cfg.tlsConfig != nil {
+		slog.Info("Using custom upstream TLS settings", "extra_ca", cfg.tlsConfig.RootCAs != nil, "client_cert", len(cfg.tlsConfig.Certificates) > 0)
+	}
+	if cfg.totalTimeout > 0 {
+		slog.Info("Upstream requests time out", "timeout", cfg.totalTimeout.String())
+	}
+}